@@ -58,7 +58,8 @@ func RequireUser() echo.MiddlewareFunc {
 }
 
 func User(e echo.Context) *UserData {
-	return e.Get(ctxKeyUser).(*UserData)
+	user, _ := e.Get(ctxKeyUser).(*UserData)
+	return user
 }
 
 func MustUser(e echo.Context) *UserData {
@@ -107,6 +108,13 @@ func (am *Middleware) completeSignIn(e echo.Context) error {
 	return e.JSON(http.StatusOK, user)
 }
 
+// SetLocale saves the signed-in user's preferred locale in their session. An empty locale clears it.
+func SetLocale(e echo.Context, locale string) error {
+	user := MustUser(e)
+	user.Locale = locale
+	return setUserSession(e, *user)
+}
+
 func setUserSession(e echo.Context, u UserData) error {
 	sess, err := session.Get(sessionKey, e)
 	if err != nil {
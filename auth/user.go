@@ -6,6 +6,8 @@ type UserData struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	Email     string `json:"email"`
+	// Locale is the user's preferred locale for challenge content, if they've picked one.
+	Locale string `json:"locale,omitempty"`
 }
 
 func init() {
@@ -17,13 +17,26 @@ type DBCfg struct {
 	TxnsNoDurable      bool   `default:"false"`
 	Debug              bool   `default:"false"`
 	ManagementInit     bool   `default:"true"`
+	SandboxBucket      string `default:"sandboxes" help:"bucket to create teams' sandboxes in - it's created at startup, if management init is on"`
+	SandboxUsername    string `default:"sandbox" help:"user to run players' data-modifying statements as - it's given access to only the sandbox bucket at startup, if management init is on"`
+	SandboxPassword    string `default:"password"`
 }
 
 type Globals struct {
 	ConfigFile               kong.ConfigFlag
 	QueryTimeout             time.Duration            `default:"15s"`
 	DatasetsPath             string                   `default:"datasets.yml"`
-	RateLimits               map[string]time.Duration `default:"query=5s;check=30s"`
+	DatasetsReloadInterval   time.Duration            `default:"5s" help:"how often to check the datasets file for changes - 0 to disable"`
+	SnapshotsDir             string                   `default:"snapshots" help:"where to store reference query snapshots, relative to the datasets file"`
+	VerifyFromSnapshots      bool                     `default:"false" help:"check submissions against stored snapshots instead of re-running the reference queries"`
+	Admins                   []string                 `help:"emails of users allowed to use the admin endpoints"`
+	DefaultLocale            string                   `default:"en" help:"locale to show challenges in when there's no translation for the user's"`
+	AllowedStatements        []string                 `default:"SELECT,EXPLAIN,ADVISE,INFER" help:"kinds of statement players are allowed to run"`
+	QueryMaxRows             int                      `default:"1000" help:"most rows to send back from a player's query - 0 for no limit"`
+	QueryMaxBytes            int                      `default:"5242880" help:"most bytes of rows to send back from a player's query - 0 for no limit"`
+	DMLStatements            []string                 `default:"INSERT,UPSERT,UPDATE,DELETE,MERGE" help:"kinds of statement players are also allowed to run on sandbox datasets and submit to data-modifying challenges"`
+	RateLimits               map[string]time.Duration `default:"query=5s;check=30s;index=30s;explain=1s"`
+	TeamIndexQuota           int                      `default:"3" help:"how many indexes each team can create"`
 	SessionKey               string                   `default:"CHANGEME"`
 	DB                       DBCfg                    `embed:"" prefix:"db."`
 	HTTPPort                 int                      `default:"7091"`
@@ -3,19 +3,103 @@ package data
 import (
 	"fmt"
 	"os"
+	"strings"
 
+	"go.uber.org/multierr"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"gopkg.in/yaml.v3"
 
 	"query-adventure/cfg"
+	"query-adventure/sqlpp"
 )
 
+// Order controls whether the order of the rows matters when checking a submission.
+type Order string
+
+const (
+	// OrderStrict requires the rows to be in exactly the same order as the reference query's. This is the default.
+	OrderStrict Order = "strict"
+	// OrderAny compares the rows as a multiset, for challenges that don't ask for a particular order.
+	OrderAny Order = "any"
+)
+
+// Tolerance allows numbers in a submission's results to differ slightly from the reference query's, for challenges
+// where floating-point results depend on how exactly the query is written. Two numbers are considered equal if they
+// are within either the absolute or relative epsilon of each other, after rounding both if Round is set.
+type Tolerance struct {
+	Absolute float64 `yaml:"absolute"`
+	Relative float64 `yaml:"relative"`
+	// Round is the number of decimal places to round to before comparing.
+	Round *int `yaml:"round"`
+}
+
+// Verify controls how a submission's results are compared to the reference query's.
+type Verify struct {
+	Order     Order      `yaml:"order"`
+	Tolerance *Tolerance `yaml:"tolerance"`
+	// MissingIsNull treats an object field that is MISSING on one side the same as a null on the other.
+	MissingIsNull bool `yaml:"missing_is_null"`
+	// NoSnapshot always runs the reference query live, for challenges whose answer changes over time (e.g. ones that
+	// use NOW_STR).
+	NoSnapshot bool `yaml:"no_snapshot"`
+	// Collections are the collections compared after running the statements, for challenges on sandbox datasets. It
+	// defaults to all of them.
+	Collections []string `yaml:"collections"`
+	// Select makes this a data-modifying challenge that's checked in a transaction rather than by comparing
+	// collections. The submission and the reference query each run in a transaction followed by this SELECT, whose
+	// results are compared, and then both are rolled back. The transactions run in a team's copy of the dataset, so
+	// the dataset needs a source, like sandbox datasets do.
+	Select string `yaml:"select"`
+}
+
+// CanSnapshot returns whether the query's reference results can be stored as snapshots. Parameterised queries can't,
+// as their results depend on the team, and nor can ones that are checked in a transaction, as they don't have any.
+func (q Query) CanSnapshot() bool {
+	return !q.Verify.NoSnapshot && len(q.Params) == 0 && !q.VerifiesInTransaction()
+}
+
 type Query struct {
-	ID        string   `yaml:"id" json:"id"`
-	Name      string   `yaml:"name" json:"name"`
-	Challenge string   `yaml:"challenge" json:"challenge"`
-	Points    uint     `yaml:"points" json:"points"`
-	Query     string   `yaml:"query" json:"query,omitempty"`
-	Hints     []string `yaml:"hints" json:"hints"`
+	ID        string `yaml:"id" json:"id"`
+	Name      string `yaml:"name" json:"name"`
+	Challenge string `yaml:"challenge" json:"challenge"`
+	Points    uint   `yaml:"points" json:"points"`
+	Query     string `yaml:"query" json:"query,omitempty"`
+	// Alternatives are other reference queries whose results are also accepted, for challenges with more than one
+	// correct result shape.
+	Alternatives []string `yaml:"alternatives" json:"-"`
+	Hints        []Hint   `yaml:"hints" json:"-"`
+	Verify       Verify   `yaml:"verify" json:"-"`
+	// Requires lists the challenges (as "dataset.query") that a team must complete before this one is unlocked.
+	Requires []string `yaml:"requires" json:"requires,omitempty"`
+	// MustUse and MustNotUse are language constructs that a submission has to (or must not) use, for challenges that
+	// are meant to teach a particular feature.
+	MustUse    []sqlpp.Construct `yaml:"must_use" json:"-"`
+	MustNotUse []sqlpp.Construct `yaml:"must_not_use" json:"-"`
+	// Performance, if set, makes this a performance challenge, scored on how efficient the correct query is.
+	Performance *Performance `yaml:"performance" json:"performance,omitempty"`
+	// Params lists the sets of values that the challenge's $placeholders can take. Each team is given one of them.
+	Params []Params `yaml:"params" json:"-"`
+	// Translations are keyed by locale (e.g. "de").
+	Translations map[string]QueryTranslation `yaml:"translations" json:"-"`
+	Window       `yaml:",inline"`
+}
+
+// IsUnlocked returns whether all the query's prerequisites are in complete, which is keyed by dataset ID and lists
+// the completed query IDs (as returned by GetTeamCompleteChallenges).
+func (q Query) IsUnlocked(complete map[string][]string) bool {
+	for _, req := range q.Requires {
+		dsID, queryID, _ := strings.Cut(req, ".")
+		if !slices.Contains(complete[dsID], queryID) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReferenceQueries returns all the reference queries whose results are accepted for this challenge, main one first.
+func (q Query) ReferenceQueries() []string {
+	return append([]string{q.Query}, q.Alternatives...)
 }
 
 type Dataset struct {
@@ -24,6 +108,17 @@ type Dataset struct {
 	Description string  `yaml:"description" json:"description"`
 	Keyspace    string  `yaml:"keyspace" json:"keyspace"`
 	Queries     []Query `yaml:"queries" json:"queries"`
+	// Translations are keyed by locale (e.g. "de").
+	Translations map[string]DatasetTranslation `yaml:"translations" json:"-"`
+	// Source is where the load command gets the dataset's documents from. Datasets without one (like the Couchbase
+	// sample buckets) have to be loaded some other way.
+	Source *Source `yaml:"source" json:"-"`
+	// Indexes are the indexes the dataset's reference queries need, which the server can create at startup.
+	Indexes []Index `yaml:"indexes" json:"-"`
+	// Sandbox makes this a data-modification dataset. Each team runs its statements against its own copy of the
+	// collections, and submissions are checked by comparing the collections afterwards rather than the returned rows.
+	Sandbox bool `yaml:"sandbox" json:"sandbox"`
+	Window  `yaml:",inline"`
 }
 
 func (d Dataset) QueryByID(id string) (Query, bool) {
@@ -46,28 +141,215 @@ func (d Datasets) DatasetByID(id string) (Dataset, bool) {
 	return Dataset{}, false
 }
 
-func (q Query) FilterForPublic(usedHints uint) Query {
+// FilterForPublic returns the parts of the query that players are allowed to see. It doesn't include the hints, as
+// which ones the player can see depends on which they've used.
+func (q Query) FilterForPublic(params Params) Query {
 	return Query{
 		ID:        q.ID,
 		Name:      q.Name,
-		Challenge: q.Challenge,
+		Challenge: params.Fill(q.Challenge),
 		Points:    q.Points,
-		Hints:     q.Hints[:usedHints],
+		Requires:  q.Requires,
+		Window:    q.Window,
+		// Players need to know the thresholds to aim for.
+		Performance: q.Performance,
+	}
+}
+
+// Validate checks that the datasets are self-consistent and won't fail at runtime, so that a broken file can be
+// rejected before it goes live. It doesn't need a cluster connection, so it can't check that the queries actually run.
+func (d Datasets) Validate() error {
+	var errs error
+	seenDatasets := make(map[string]bool)
+	for i, ds := range d {
+		if ds.ID == "" {
+			multierr.AppendInto(&errs, fmt.Errorf("dataset %d has no ID", i))
+			continue
+		}
+		if seenDatasets[ds.ID] {
+			multierr.AppendInto(&errs, fmt.Errorf("duplicate dataset ID %q", ds.ID))
+		}
+		seenDatasets[ds.ID] = true
+		if bucket, scope, ok := strings.Cut(ds.Keyspace, "."); !ok || bucket == "" || scope == "" || strings.Contains(scope, ".") {
+			multierr.AppendInto(&errs, fmt.Errorf("dataset %q: keyspace %q is not of the form bucket.scope", ds.ID, ds.Keyspace))
+		}
+		if w := ds.Window; w.AvailableFrom != nil && w.AvailableUntil != nil && !w.AvailableFrom.Before(*w.AvailableUntil) {
+			multierr.AppendInto(&errs, fmt.Errorf("dataset %q closes before it opens", ds.ID))
+		}
+		for locale := range ds.Translations {
+			if err := validateLocale(locale); err != nil {
+				multierr.AppendInto(&errs, fmt.Errorf("dataset %q: %w", ds.ID, err))
+			}
+		}
+		if err := validateIndexes(ds.Indexes); err != nil {
+			multierr.AppendInto(&errs, fmt.Errorf("dataset %q: %w", ds.ID, err))
+		}
+		if ds.Source != nil {
+			if err := ds.Source.validate(); err != nil {
+				multierr.AppendInto(&errs, fmt.Errorf("dataset %q: %w", ds.ID, err))
+			}
+		}
+		if err := ds.validateSandbox(); err != nil {
+			multierr.AppendInto(&errs, fmt.Errorf("dataset %q: %w", ds.ID, err))
+		}
+		seenQueries := make(map[string]bool)
+		for j, q := range ds.Queries {
+			if q.ID == "" {
+				multierr.AppendInto(&errs, fmt.Errorf("query %d in dataset %q has no ID", j, ds.ID))
+				continue
+			}
+			if seenQueries[q.ID] {
+				multierr.AppendInto(&errs, fmt.Errorf("duplicate query ID %s.%s", ds.ID, q.ID))
+			}
+			seenQueries[q.ID] = true
+			if q.Points == 0 {
+				multierr.AppendInto(&errs, fmt.Errorf("query %s.%s is worth zero points", ds.ID, q.ID))
+			}
+			if strings.TrimSpace(q.Query) == "" {
+				multierr.AppendInto(&errs, fmt.Errorf("query %s.%s has no reference query", ds.ID, q.ID))
+			}
+			for _, c := range q.MustUse {
+				if slices.Contains(q.MustNotUse, c) {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s.%s both requires and forbids %s", ds.ID, q.ID, c))
+				}
+			}
+			for locale, t := range q.Translations {
+				if err := validateLocale(locale); err != nil {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s.%s: %w", ds.ID, q.ID, err))
+				}
+				if len(t.Hints) > len(q.Hints) {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s.%s: %q translation has more hints than the query", ds.ID, q.ID, locale))
+				}
+			}
+			for k, hint := range q.Hints {
+				if err := hint.validate(); err != nil {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s.%s: hint %d: %w", ds.ID, q.ID, k, err))
+				}
+			}
+			if q.Performance != nil {
+				if err := q.Performance.validate(); err != nil {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s.%s: %w", ds.ID, q.ID, err))
+				}
+			}
+			if err := q.validateParams(); err != nil {
+				multierr.AppendInto(&errs, fmt.Errorf("query %s.%s: %w", ds.ID, q.ID, err))
+			}
+			if w := ds.QueryWindow(q); w.AvailableFrom != nil && w.AvailableUntil != nil && !w.AvailableFrom.Before(*w.AvailableUntil) {
+				multierr.AppendInto(&errs, fmt.Errorf("query %s.%s closes before it opens", ds.ID, q.ID))
+			}
+			for k, alt := range q.Alternatives {
+				if strings.TrimSpace(alt) == "" {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s.%s: alternative %d is empty", ds.ID, q.ID, k))
+				}
+			}
+			switch q.Verify.Order {
+			case "", OrderStrict, OrderAny:
+			default:
+				multierr.AppendInto(&errs, fmt.Errorf("query %s.%s: unknown verify order %q", ds.ID, q.ID, q.Verify.Order))
+			}
+			if t := q.Verify.Tolerance; t != nil {
+				if t.Absolute < 0 || t.Relative < 0 {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s.%s: tolerance must not be negative", ds.ID, q.ID))
+				}
+				if t.Round != nil && (*t.Round < 0 || *t.Round > 15) {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s.%s: can only round to between 0 and 15 decimal places", ds.ID, q.ID))
+				}
+			}
+		}
+	}
+	multierr.AppendInto(&errs, d.validateRequires())
+	return errs
+}
+
+// validateRequires checks that every prerequisite refers to a challenge that exists, and that there are no cycles
+// (which would make the challenges involved impossible to unlock).
+func (d Datasets) validateRequires() error {
+	var errs error
+	graph := make(map[string][]string)
+	for _, ds := range d {
+		for _, q := range ds.Queries {
+			key := ds.ID + "." + q.ID
+			for _, req := range q.Requires {
+				dsID, queryID, ok := strings.Cut(req, ".")
+				if !ok {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s: requirement %q is not of the form dataset.query", key, req))
+					continue
+				}
+				reqDS, ok := d.DatasetByID(dsID)
+				if !ok {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s: requirement %q refers to an unknown dataset", key, req))
+					continue
+				}
+				if _, ok = reqDS.QueryByID(queryID); !ok {
+					multierr.AppendInto(&errs, fmt.Errorf("query %s: requirement %q refers to an unknown query", key, req))
+					continue
+				}
+				graph[key] = append(graph[key], req)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(key string, path []string) error
+	visit = func(key string, path []string) error {
+		switch state[key] {
+		case visiting:
+			return fmt.Errorf("prerequisite cycle: %s", strings.Join(append(path, key), " -> "))
+		case visited:
+			return nil
+		}
+		state[key] = visiting
+		for _, req := range graph[key] {
+			if err := visit(req, append(path, key)); err != nil {
+				return err
+			}
+		}
+		state[key] = visited
+		return nil
 	}
+	keys := maps.Keys(graph)
+	slices.Sort(keys)
+	for _, key := range keys {
+		// Once we've found one cycle the visit states are unreliable, so stop there.
+		if err := visit(key, nil); err != nil {
+			multierr.AppendInto(&errs, err)
+			break
+		}
+	}
+	return errs
 }
 
 func LoadDatasets(g *cfg.Globals) (Datasets, error) {
-	fd, err := os.Open(g.DatasetsPath)
+	ds, err := ReadDatasetsFile(g.DatasetsPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = ds.Validate(); err != nil {
+		return nil, fmt.Errorf("validate %q: %w", g.DatasetsPath, err)
+	}
+	return ds, nil
+}
+
+// ReadDatasetsFile decodes the datasets file at path, without validating its contents.
+func ReadDatasetsFile(path string) (Datasets, error) {
+	fd, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("open %q: %w", g.DatasetsPath, err)
+		return nil, fmt.Errorf("open %q: %w", path, err)
 	}
 	defer func(fd *os.File) {
 		_ = fd.Close()
 	}(fd)
 	var ds Datasets
-	err = yaml.NewDecoder(fd).Decode(&ds)
+	dec := yaml.NewDecoder(fd)
+	dec.KnownFields(true)
+	err = dec.Decode(&ds)
 	if err != nil {
-		return nil, fmt.Errorf("decode %q: %w", g.DatasetsPath, err)
+		return nil, fmt.Errorf("decode %q: %w", path, err)
 	}
 	return ds, nil
 }
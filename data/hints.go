@@ -0,0 +1,112 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+type HintType string
+
+const (
+	// HintText is a fixed piece of text written by the challenge author.
+	HintText HintType = "text"
+	// HintColumns reveals the names of the columns in the expected result.
+	HintColumns HintType = "columns"
+	// HintFirstRow reveals the first row of the expected result.
+	HintFirstRow HintType = "first_row"
+)
+
+type Hint struct {
+	Type HintType `yaml:"type" json:"type"`
+	Text string   `yaml:"text" json:"-"`
+	// Multiplier scales the challenge's points if this hint is used. If neither Multiplier nor Deduction is set, the
+	// global ScoreHintMultiplier is used.
+	Multiplier *float64 `yaml:"multiplier" json:"multiplier,omitempty"`
+	// Deduction is a flat number of points taken off if this hint is used, after all the multipliers.
+	Deduction float64 `yaml:"deduction" json:"deduction,omitempty"`
+}
+
+// UnmarshalYAML allows a hint to be written as a plain string, for a text hint with the default cost.
+func (h *Hint) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*h = Hint{Type: HintText}
+		return value.Decode(&h.Text)
+	}
+	type plainHint Hint
+	var ph plainHint
+	if err := value.Decode(&ph); err != nil {
+		return err
+	}
+	*h = Hint(ph)
+	if h.Type == "" {
+		h.Type = HintText
+	}
+	return nil
+}
+
+// NeedsReferenceRow returns whether the hint is generated from the first row of the reference query's result.
+func (h Hint) NeedsReferenceRow() bool {
+	return h.Type == HintColumns || h.Type == HintFirstRow
+}
+
+// Generate returns the text to show the player for this hint. For generated hints, firstRow is the first row of the
+// reference query's result, and hasRow is false if it returned no rows.
+func (h Hint) Generate(params Params, firstRow any, hasRow bool) string {
+	switch h.Type {
+	case HintColumns:
+		if !hasRow {
+			return "The expected result has no rows, so there are no columns to reveal."
+		}
+		obj, ok := firstRow.(map[string]any)
+		if !ok {
+			return "The expected result is made up of raw values rather than objects - you may need to use SELECT RAW."
+		}
+		cols := maps.Keys(obj)
+		slices.Sort(cols)
+		return fmt.Sprintf("The expected result has these columns: %s.", strings.Join(cols, ", "))
+	case HintFirstRow:
+		if !hasRow {
+			return "The expected result has no rows."
+		}
+		jv, _ := json.Marshal(firstRow)
+		return fmt.Sprintf("The first row of the expected result is %s.", jv)
+	default:
+		return params.Fill(h.Text)
+	}
+}
+
+// Apply returns the points after this hint's multiplier, using defaultMultiplier if it doesn't set its own cost.
+// Deductions are taken off separately, after all the multipliers.
+func (h Hint) Apply(points, defaultMultiplier float64) float64 {
+	if h.Multiplier != nil {
+		return points * *h.Multiplier
+	}
+	if h.Deduction == 0 {
+		return points * defaultMultiplier
+	}
+	return points
+}
+
+func (h Hint) validate() error {
+	switch h.Type {
+	case HintText:
+		if strings.TrimSpace(h.Text) == "" {
+			return fmt.Errorf("text hint is empty")
+		}
+	case HintColumns, HintFirstRow:
+	default:
+		return fmt.Errorf("unknown hint type %q", h.Type)
+	}
+	if h.Multiplier != nil && (*h.Multiplier < 0 || *h.Multiplier > 1) {
+		return fmt.Errorf("hint multiplier must be between 0 and 1")
+	}
+	if h.Deduction < 0 {
+		return fmt.Errorf("hint deduction must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Index is a secondary (or primary) index that a dataset's reference queries rely on.
+type Index struct {
+	Name       string `yaml:"name"`
+	Collection string `yaml:"collection"`
+	Primary    bool   `yaml:"primary"`
+	// Keys are the index key expressions, such as "trip_id" or "LOWER(stop_name)".
+	Keys  []string `yaml:"keys"`
+	Where string   `yaml:"where"`
+}
+
+// CreateStatement returns the statement to create the index in its dataset's scope, deferring the build so that all of
+// a collection's indexes can be built together.
+func (i Index) CreateStatement() string {
+	var sb strings.Builder
+	if i.Primary {
+		fmt.Fprintf(&sb, "CREATE PRIMARY INDEX `%s` ON `%s`", i.Name, i.Collection)
+	} else {
+		fmt.Fprintf(&sb, "CREATE INDEX `%s` ON `%s` (%s)", i.Name, i.Collection, strings.Join(i.Keys, ", "))
+		if i.Where != "" {
+			fmt.Fprintf(&sb, " WHERE %s", i.Where)
+		}
+	}
+	sb.WriteString(` WITH {"defer_build": true}`)
+	return sb.String()
+}
+
+func validateIndexes(indexes []Index) error {
+	seen := make(map[string]bool)
+	for k, idx := range indexes {
+		if idx.Name == "" {
+			return fmt.Errorf("index %d has no name", k)
+		}
+		if seen[idx.Name] {
+			return fmt.Errorf("duplicate index %q", idx.Name)
+		}
+		seen[idx.Name] = true
+		if idx.Collection == "" {
+			return fmt.Errorf("index %q has no collection", idx.Name)
+		}
+		if idx.Primary && (len(idx.Keys) > 0 || idx.Where != "") {
+			return fmt.Errorf("primary index %q can't have keys or a where clause", idx.Name)
+		}
+		if !idx.Primary && len(idx.Keys) == 0 {
+			return fmt.Errorf("index %q has no keys", idx.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package data
+
+import (
+	"fmt"
+
+	"golang.org/x/text/language"
+)
+
+// DatasetTranslation overrides a dataset's text for one locale. Empty fields fall back to the default locale.
+type DatasetTranslation struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+}
+
+// QueryTranslation overrides a challenge's text for one locale. Empty fields fall back to the default locale. Hints
+// are matched up by index, and only apply to text hints.
+type QueryTranslation struct {
+	Name      string   `yaml:"name"`
+	Challenge string   `yaml:"challenge"`
+	Hints     []string `yaml:"hints"`
+}
+
+// Locales returns all the locales that any dataset or challenge has been translated into.
+func (d Datasets) Locales() []string {
+	seen := make(map[string]bool)
+	var result []string
+	add := func(locale string) {
+		if !seen[locale] {
+			seen[locale] = true
+			result = append(result, locale)
+		}
+	}
+	for _, ds := range d {
+		for locale := range ds.Translations {
+			add(locale)
+		}
+		for _, q := range ds.Queries {
+			for locale := range q.Translations {
+				add(locale)
+			}
+		}
+	}
+	return result
+}
+
+// Localize returns a copy of the dataset (including its queries) with its text in the given locale, where there's a
+// translation for it.
+func (d Dataset) Localize(locale string) Dataset {
+	if t, ok := d.Translations[locale]; ok {
+		if t.Name != "" {
+			d.Name = t.Name
+		}
+		if t.Description != "" {
+			d.Description = t.Description
+		}
+	}
+	queries := make([]Query, len(d.Queries))
+	for i, q := range d.Queries {
+		queries[i] = q.Localize(locale)
+	}
+	d.Queries = queries
+	return d
+}
+
+// Localize returns a copy of the query with its text in the given locale, where there's a translation for it.
+func (q Query) Localize(locale string) Query {
+	t, ok := q.Translations[locale]
+	if !ok {
+		return q
+	}
+	if t.Name != "" {
+		q.Name = t.Name
+	}
+	if t.Challenge != "" {
+		q.Challenge = t.Challenge
+	}
+	hints := make([]Hint, len(q.Hints))
+	copy(hints, q.Hints)
+	for i, text := range t.Hints {
+		if i < len(hints) && hints[i].Type == HintText && text != "" {
+			hints[i].Text = text
+		}
+	}
+	q.Hints = hints
+	return q
+}
+
+func validateLocale(locale string) error {
+	if _, err := language.Parse(locale); err != nil {
+		return fmt.Errorf("invalid locale %q: %w", locale, err)
+	}
+	return nil
+}
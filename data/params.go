@@ -0,0 +1,71 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Params are the values of a parameterised challenge's placeholders for one team. They're passed as named parameters
+// to both the reference and submitted queries, and filled into the challenge text.
+type Params map[string]any
+
+var placeholderRe = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// Fill replaces $name placeholders in text with the corresponding values. Placeholders without a value are left as
+// they are.
+func (p Params) Fill(text string) string {
+	if len(p) == 0 {
+		return text
+	}
+	return placeholderRe.ReplaceAllStringFunc(text, func(placeholder string) string {
+		val, ok := p[placeholder[1:]]
+		if !ok {
+			return placeholder
+		}
+		if str, ok := val.(string); ok {
+			return str
+		}
+		jv, err := json.Marshal(val)
+		if err != nil {
+			return fmt.Sprint(val)
+		}
+		return string(jv)
+	})
+}
+
+// ParamsForTeam deterministically picks one of the query's parameter sets for the team, so that different teams get
+// different answers. It returns nil if the query isn't parameterised.
+func (q Query) ParamsForTeam(datasetID, teamID string) Params {
+	if len(q.Params) == 0 {
+		return nil
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(teamID + "::" + datasetID + "::" + q.ID))
+	return q.Params[h.Sum32()%uint32(len(q.Params))]
+}
+
+// validateParams checks that all the query's parameter sets define the same placeholders.
+func (q Query) validateParams() error {
+	if len(q.Params) == 0 {
+		return nil
+	}
+	want := maps.Keys(q.Params[0])
+	slices.Sort(want)
+	for i, p := range q.Params {
+		if len(p) == 0 {
+			return fmt.Errorf("parameter set %d is empty", i)
+		}
+		got := maps.Keys(p)
+		slices.Sort(got)
+		if !slices.Equal(want, got) {
+			return fmt.Errorf("parameter set %d has placeholders [%s], but set 0 has [%s]", i, strings.Join(got, ", "), strings.Join(want, ", "))
+		}
+	}
+	return nil
+}
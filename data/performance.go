@@ -0,0 +1,101 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Performance makes a challenge's points depend on how efficient the correct query is, for index-design rounds. Each
+// configured metric scales the points by a multiplier, and the multipliers are combined.
+type Performance struct {
+	Elapsed          *DurationThreshold `yaml:"elapsed" json:"elapsed,omitempty"`
+	DocumentsFetched *CountThreshold    `yaml:"documents_fetched" json:"documents_fetched,omitempty"`
+	// PrimaryScanMultiplier is applied if the query used a primary scan. Leave unset to not penalise them.
+	PrimaryScanMultiplier *float64 `yaml:"primary_scan_multiplier" json:"primary_scan_multiplier,omitempty"`
+}
+
+// DurationThreshold gives full points for a duration of at most Full, MinMultiplier for one of at least Worst, and
+// interpolates linearly in between.
+type DurationThreshold struct {
+	Full          time.Duration `yaml:"full"`
+	Worst         time.Duration `yaml:"worst"`
+	MinMultiplier float64       `yaml:"min_multiplier"`
+}
+
+// MarshalJSON sends the durations to players in milliseconds, rather than as nanoseconds that only make sense in Go.
+func (t DurationThreshold) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		FullMS        float64 `json:"full_ms,omitempty"`
+		WorstMS       float64 `json:"worst_ms,omitempty"`
+		MinMultiplier float64 `json:"min_multiplier,omitempty"`
+	}{
+		FullMS:        float64(t.Full) / float64(time.Millisecond),
+		WorstMS:       float64(t.Worst) / float64(time.Millisecond),
+		MinMultiplier: t.MinMultiplier,
+	})
+}
+
+// CountThreshold is like DurationThreshold, but for counts such as the number of documents fetched.
+type CountThreshold struct {
+	Full          uint64  `yaml:"full" json:"full,omitempty"`
+	Worst         uint64  `yaml:"worst" json:"worst,omitempty"`
+	MinMultiplier float64 `yaml:"min_multiplier" json:"min_multiplier,omitempty"`
+}
+
+func interpolateMultiplier(value, full, worst, minMultiplier float64) float64 {
+	switch {
+	case value <= full:
+		return 1
+	case value >= worst:
+		return minMultiplier
+	default:
+		return 1 - (1-minMultiplier)*(value-full)/(worst-full)
+	}
+}
+
+// Multiplier returns how much to scale the challenge's points by, given the submitted query's metrics.
+func (p Performance) Multiplier(elapsed time.Duration, documentsFetched uint64, primaryScan bool) float64 {
+	result := 1.0
+	if t := p.Elapsed; t != nil {
+		result *= interpolateMultiplier(float64(elapsed), float64(t.Full), float64(t.Worst), t.MinMultiplier)
+	}
+	if t := p.DocumentsFetched; t != nil {
+		result *= interpolateMultiplier(float64(documentsFetched), float64(t.Full), float64(t.Worst), t.MinMultiplier)
+	}
+	if primaryScan && p.PrimaryScanMultiplier != nil {
+		result *= *p.PrimaryScanMultiplier
+	}
+	return result
+}
+
+// WorstMultiplier returns the lowest multiplier that Multiplier can give, for when the query's metrics are missing.
+func (p Performance) WorstMultiplier() float64 {
+	result := 1.0
+	if t := p.Elapsed; t != nil {
+		result *= t.MinMultiplier
+	}
+	if t := p.DocumentsFetched; t != nil {
+		result *= t.MinMultiplier
+	}
+	if p.PrimaryScanMultiplier != nil {
+		result *= *p.PrimaryScanMultiplier
+	}
+	return result
+}
+
+func (p Performance) validate() error {
+	if p.Elapsed == nil && p.DocumentsFetched == nil && p.PrimaryScanMultiplier == nil {
+		return fmt.Errorf("performance scoring has no metrics")
+	}
+	if t := p.Elapsed; t != nil && (t.Full >= t.Worst || t.MinMultiplier < 0 || t.MinMultiplier > 1) {
+		return fmt.Errorf("elapsed threshold must have full < worst and 0 <= min_multiplier <= 1")
+	}
+	if t := p.DocumentsFetched; t != nil && (t.Full >= t.Worst || t.MinMultiplier < 0 || t.MinMultiplier > 1) {
+		return fmt.Errorf("documents_fetched threshold must have full < worst and 0 <= min_multiplier <= 1")
+	}
+	if m := p.PrimaryScanMultiplier; m != nil && (*m < 0 || *m > 1) {
+		return fmt.Errorf("primary_scan_multiplier must be between 0 and 1")
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package data
+
+import (
+	"fmt"
+
+	"golang.org/x/exp/slices"
+)
+
+// SandboxCollections returns the collections that are copied into each of the dataset's sandboxes (see HasSandboxes).
+func (d Dataset) SandboxCollections() []string {
+	if d.Source == nil {
+		return nil
+	}
+	result := make([]string, len(d.Source.Collections))
+	for i, cs := range d.Source.Collections {
+		result[i] = cs.Collection
+	}
+	return result
+}
+
+// CompareCollections returns the collections whose contents are compared when checking a submission to a sandbox
+// dataset's challenge.
+func (q Query) CompareCollections(ds Dataset) []string {
+	if len(q.Verify.Collections) > 0 {
+		return q.Verify.Collections
+	}
+	return ds.SandboxCollections()
+}
+
+// VerifiesInTransaction returns whether submissions to the challenge are data-modifying statements, which are checked
+// by running them in a transaction that's rolled back (see Verify.Select).
+func (q Query) VerifiesInTransaction() bool {
+	return q.Verify.Select != ""
+}
+
+// HasSandboxes returns whether teams get their own copies of the dataset: either because it's a sandbox dataset, or
+// because it has data-modifying challenges, whose transactions run against a copy rather than the shared dataset.
+func (d Dataset) HasSandboxes() bool {
+	if d.Sandbox {
+		return true
+	}
+	return slices.IndexFunc(d.Queries, Query.VerifiesInTransaction) >= 0
+}
+
+// validateSandbox checks that a dataset with sandboxes has everything that's needed to copy it, and that none of its
+// challenges would end up running their (data-modifying) reference queries against the shared dataset.
+func (d Dataset) validateSandbox() error {
+	if d.HasSandboxes() {
+		if err := d.validateSource(); err != nil {
+			return err
+		}
+	}
+	if !d.Sandbox {
+		for _, q := range d.Queries {
+			if len(q.Verify.Collections) > 0 {
+				return fmt.Errorf("query %q compares collections, but the dataset isn't a sandbox", q.ID)
+			}
+			if q.VerifiesInTransaction() {
+				if err := q.validateModifying(); err != nil {
+					return fmt.Errorf("query %q: %w", q.ID, err)
+				}
+			}
+		}
+		return nil
+	}
+	collections := d.SandboxCollections()
+	for _, q := range d.Queries {
+		for _, coll := range q.Verify.Collections {
+			if !slices.Contains(collections, coll) {
+				return fmt.Errorf("query %q compares collection %q, which isn't in the sandbox", q.ID, coll)
+			}
+		}
+		if q.VerifiesInTransaction() {
+			return fmt.Errorf("query %q: sandbox challenges are checked by comparing collections, so can't have a verify select", q.ID)
+		}
+		if err := q.validateModifying(); err != nil {
+			return fmt.Errorf("query %q: %w", q.ID, err)
+		}
+	}
+	return nil
+}
+
+// validateSource checks that the dataset says which collections to copy into its sandboxes, and can copy them.
+func (d Dataset) validateSource() error {
+	if d.Source == nil {
+		return fmt.Errorf("datasets with sandboxes need a source, to know which collections to copy")
+	}
+	for _, coll := range d.SandboxCollections() {
+		// The copy is an INSERT ... SELECT, which needs a primary index to scan the original collection.
+		hasPrimary := slices.IndexFunc(d.Indexes, func(idx Index) bool {
+			return idx.Primary && idx.Collection == coll
+		}) >= 0
+		if !hasPrimary {
+			return fmt.Errorf("sandbox collection %q has no primary index", coll)
+		}
+	}
+	return nil
+}
+
+// validateModifying checks that a data-modifying challenge doesn't use anything that would run its reference query
+// outside a sandbox or transaction, or that only makes sense for challenges that return rows.
+func (q Query) validateModifying() error {
+	if len(q.Alternatives) > 0 {
+		return fmt.Errorf("data-modifying challenges can't have alternatives")
+	}
+	for k, hint := range q.Hints {
+		if hint.NeedsReferenceRow() {
+			return fmt.Errorf("hint %d needs the reference query's results, which data-modifying challenges don't have", k)
+		}
+	}
+	if q.Performance != nil {
+		return fmt.Errorf("data-modifying challenges can't be performance challenges")
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package data
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SourceFormat is the format of a source file.
+type SourceFormat string
+
+const (
+	// FormatCSV is a CSV file with a header row. The file extension doesn't matter, so GTFS .txt files work too.
+	FormatCSV SourceFormat = "csv"
+	// FormatJSONList is a JSON file containing one array of documents.
+	FormatJSONList SourceFormat = "json"
+	// FormatJSONLines is a file with one JSON document per line.
+	FormatJSONLines SourceFormat = "jsonl"
+)
+
+// Source describes where a dataset's documents come from, so that the load command can create and fill its keyspace.
+type Source struct {
+	Bucket      BucketSource       `yaml:"bucket"`
+	Collections []CollectionSource `yaml:"collections"`
+}
+
+// BucketSource holds the settings used if the loader needs to create the dataset's bucket.
+type BucketSource struct {
+	RAMQuotaMB uint64 `yaml:"ram_quota_mb"`
+	// StorageBackend is "couchstore" (the default) or "magma".
+	StorageBackend string `yaml:"storage_backend"`
+	Replicas       uint32 `yaml:"replicas"`
+}
+
+// CollectionSource is a file to load into one collection in the dataset's scope.
+type CollectionSource struct {
+	Collection string `yaml:"collection"`
+	// File is taken relative to the directory containing the datasets file.
+	File   string       `yaml:"file"`
+	Format SourceFormat `yaml:"format"`
+	// Key is the template for each document's key, such as "%trip_id%::%stop_id%", where each %field% is replaced with
+	// the value of that field in the document.
+	Key string `yaml:"key"`
+	// InferTypes turns CSV fields that look like numbers or booleans into them, rather than leaving everything as
+	// strings.
+	InferTypes bool `yaml:"infer_types"`
+}
+
+var keyFieldRe = regexp.MustCompile(`%([^%]+)%`)
+
+// KeyFor fills in the key template from the document.
+func (cs CollectionSource) KeyFor(doc map[string]any) (string, error) {
+	var err error
+	key := keyFieldRe.ReplaceAllStringFunc(cs.Key, func(match string) string {
+		field := match[1 : len(match)-1]
+		val, ok := doc[field]
+		if !ok || val == nil {
+			if err == nil {
+				err = fmt.Errorf("document has no %q field for its key", field)
+			}
+			return ""
+		}
+		switch v := val.(type) {
+		case string:
+			return v
+		case json.Number:
+			return v.String()
+		default:
+			return fmt.Sprint(v)
+		}
+	})
+	return key, err
+}
+
+// ReadDocuments calls fn with each document in the source file, along with its key, stopping at the first error.
+// Files are read as they go rather than all at once, as some (like GTFS stop_times) are too big to hold in memory.
+func (cs CollectionSource) ReadDocuments(baseDir string, fn func(key string, doc map[string]any) error) error {
+	path := cs.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer fd.Close()
+	emit := func(doc map[string]any) error {
+		key, err := cs.KeyFor(doc)
+		if err != nil {
+			return err
+		}
+		return fn(key, doc)
+	}
+	switch cs.format() {
+	case FormatCSV:
+		return readCSV(fd, cs.InferTypes, emit)
+	case FormatJSONList:
+		return readJSONList(fd, emit)
+	case FormatJSONLines:
+		return readJSONLines(fd, emit)
+	default:
+		return fmt.Errorf("unknown source format %q", cs.Format)
+	}
+}
+
+// format returns the source's format, guessing it from the file extension if it isn't set.
+func (cs CollectionSource) format() SourceFormat {
+	if cs.Format != "" {
+		return cs.Format
+	}
+	switch strings.ToLower(filepath.Ext(cs.File)) {
+	case ".json":
+		return FormatJSONList
+	case ".jsonl", ".ndjson":
+		return FormatJSONLines
+	default:
+		return FormatCSV
+	}
+}
+
+func readCSV(r io.Reader, inferTypes bool, emit func(map[string]any) error) error {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	header = append([]string(nil), header...)
+	// Some exporters (including TfGM's) start the file with a byte order mark.
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read CSV: %w", err)
+		}
+		doc := make(map[string]any, len(header))
+		for i, field := range header {
+			if i >= len(record) {
+				break
+			}
+			if inferTypes {
+				doc[field] = inferType(record[i])
+			} else {
+				doc[field] = record[i]
+			}
+		}
+		if err = emit(doc); err != nil {
+			line, _ := cr.FieldPos(0)
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+// jsonNumberRe matches numbers as JSON would write them, so that inferType leaves alone things like IDs with leading
+// zeroes or "NaN", which wouldn't survive the round trip.
+var jsonNumberRe = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// inferType converts a CSV field to a number or boolean if it looks like one.
+func inferType(s string) any {
+	if jsonNumberRe.MatchString(s) {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return s
+}
+
+func readJSONList(r io.Reader, emit func(map[string]any) error) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read JSON: %w", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected a JSON array of documents")
+	}
+	for i := 0; dec.More(); i++ {
+		var doc map[string]any
+		if err = dec.Decode(&doc); err != nil {
+			return fmt.Errorf("document %d: %w", i, err)
+		}
+		if err = emit(doc); err != nil {
+			return fmt.Errorf("document %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func readJSONLines(r io.Reader, emit func(map[string]any) error) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	for i := 1; ; i++ {
+		var doc map[string]any
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i, err)
+		}
+		if err = emit(doc); err != nil {
+			return fmt.Errorf("line %d: %w", i, err)
+		}
+	}
+}
+
+func (s *Source) validate() error {
+	switch s.Bucket.StorageBackend {
+	case "", "couchstore", "magma":
+	default:
+		return fmt.Errorf("unknown storage backend %q", s.Bucket.StorageBackend)
+	}
+	if len(s.Collections) == 0 {
+		return fmt.Errorf("source has no collections")
+	}
+	for i, cs := range s.Collections {
+		if cs.Collection == "" {
+			return fmt.Errorf("collection source %d has no collection", i)
+		}
+		if cs.File == "" {
+			return fmt.Errorf("collection %q: no file", cs.Collection)
+		}
+		switch cs.format() {
+		case FormatCSV, FormatJSONList, FormatJSONLines:
+		default:
+			return fmt.Errorf("collection %q: unknown format %q", cs.Collection, cs.Format)
+		}
+		if !keyFieldRe.MatchString(cs.Key) {
+			return fmt.Errorf("collection %q: key template %q doesn't use any fields", cs.Collection, cs.Key)
+		}
+	}
+	return nil
+}
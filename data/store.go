@@ -0,0 +1,117 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Store holds the currently live Datasets and allows them to be swapped out for a freshly loaded copy without
+// restarting the server. Handlers should call Get once per request and use the returned Datasets throughout, so that
+// a reload half-way through a request can't give them an inconsistent view.
+type Store struct {
+	path string
+
+	// reloadMu is held for the whole of a reload, so that concurrent reloads (say from the watcher and an admin) can't
+	// finish out of order and leave an older copy of the file live.
+	reloadMu sync.Mutex
+
+	mu         sync.RWMutex
+	ds         Datasets
+	modTime    time.Time
+	lastErr    error
+	lastReload time.Time
+}
+
+// NewStore loads the datasets file at path. It fails if the initial load fails, as there's nothing to fall back to.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the currently live datasets.
+func (s *Store) Get() Datasets {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ds
+}
+
+// LastReload returns when the datasets were last reloaded, along with the error if that reload failed.
+func (s *Store) LastReload() (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastReload, s.lastErr
+}
+
+// Reload loads and validates the datasets file, and swaps it in if it's valid. If it's not, the old datasets stay live
+// and the error is returned (and remembered for LastReload).
+func (s *Store) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	stat, err := os.Stat(s.path)
+	if err != nil {
+		return s.fail(fmt.Errorf("stat %q: %w", s.path, err))
+	}
+	ds, err := ReadDatasetsFile(s.path)
+	if err != nil {
+		return s.fail(err)
+	}
+	if err = ds.Validate(); err != nil {
+		return s.fail(fmt.Errorf("validate %q: %w", s.path, err))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ds = ds
+	s.modTime = stat.ModTime()
+	s.lastErr = nil
+	s.lastReload = time.Now()
+	return nil
+}
+
+func (s *Store) fail(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+	s.lastReload = time.Now()
+	return err
+}
+
+// Watch polls the datasets file every interval and reloads it when its modification time changes, until ctx is done.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stat, err := os.Stat(s.path)
+		if err != nil {
+			log.Printf("Failed to stat datasets file: %v", err)
+			continue
+		}
+		s.mu.RLock()
+		changed := !stat.ModTime().Equal(s.modTime)
+		s.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		log.Printf("Datasets file %q changed, reloading", s.path)
+		if err = s.Reload(); err != nil {
+			log.Printf("Failed to reload datasets, keeping the old ones: %v", err)
+			// Don't keep retrying the same broken file every tick.
+			s.mu.Lock()
+			s.modTime = stat.ModTime()
+			s.mu.Unlock()
+			continue
+		}
+		log.Printf("Reloaded datasets")
+	}
+}
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// Window is the period during which a dataset or challenge is available. Either end may be left open.
+type Window struct {
+	AvailableFrom  *time.Time `yaml:"available_from" json:"availableFrom,omitempty"`
+	AvailableUntil *time.Time `yaml:"available_until" json:"availableUntil,omitempty"`
+}
+
+// IsReleased returns whether the window has opened by now.
+func (w Window) IsReleased(now time.Time) bool {
+	return w.AvailableFrom == nil || !now.Before(*w.AvailableFrom)
+}
+
+// IsClosed returns whether the window has closed by now.
+func (w Window) IsClosed(now time.Time) bool {
+	return w.AvailableUntil != nil && !now.Before(*w.AvailableUntil)
+}
+
+// intersect returns the window during which both w and o are open.
+func (w Window) intersect(o Window) Window {
+	result := w
+	if o.AvailableFrom != nil && (result.AvailableFrom == nil || o.AvailableFrom.After(*result.AvailableFrom)) {
+		result.AvailableFrom = o.AvailableFrom
+	}
+	if o.AvailableUntil != nil && (result.AvailableUntil == nil || o.AvailableUntil.Before(*result.AvailableUntil)) {
+		result.AvailableUntil = o.AvailableUntil
+	}
+	return result
+}
+
+// QueryWindow returns when the query is actually available, taking into account the dataset's window as well as its
+// own.
+func (d Dataset) QueryWindow(q Query) Window {
+	return d.Window.intersect(q.Window)
+}
+
+// NextRelease returns the earliest time after now at which a dataset or challenge will be released, or nil if
+// everything has already been released.
+func (d Datasets) NextRelease(now time.Time) *time.Time {
+	var next *time.Time
+	consider := func(w Window) {
+		if w.AvailableFrom != nil && w.AvailableFrom.After(now) && (next == nil || w.AvailableFrom.Before(*next)) {
+			next = w.AvailableFrom
+		}
+	}
+	for _, ds := range d {
+		consider(ds.Window)
+		for _, q := range ds.Queries {
+			consider(ds.QueryWindow(q))
+		}
+	}
+	return next
+}
+
+// Released returns only the datasets and challenges that have been released by now.
+func (d Datasets) Released(now time.Time) Datasets {
+	result := make(Datasets, 0, len(d))
+	for _, ds := range d {
+		if !ds.IsReleased(now) {
+			continue
+		}
+		queries := make([]Query, 0, len(ds.Queries))
+		for _, q := range ds.Queries {
+			if ds.QueryWindow(q).IsReleased(now) {
+				queries = append(queries, q)
+			}
+		}
+		ds.Queries = queries
+		result = append(result, ds)
+	}
+	return result
+}
+
+// UnreleasedKeyspaces returns the keyspaces of the datasets that haven't been released by now, so that statements can
+// be stopped from reaching them by a full path. Where no released dataset shares its bucket, that's just the bucket;
+// otherwise, it's the bucket.scope keyspace itself.
+func (d Datasets) UnreleasedKeyspaces(now time.Time) []string {
+	releasedBuckets := make(map[string]bool)
+	for _, ds := range d {
+		if ds.IsReleased(now) {
+			bucket, _, _ := strings.Cut(ds.Keyspace, ".")
+			releasedBuckets[bucket] = true
+		}
+	}
+	var result []string
+	for _, ds := range d {
+		if ds.IsReleased(now) {
+			continue
+		}
+		keyspace, _, _ := strings.Cut(ds.Keyspace, ".")
+		if releasedBuckets[keyspace] {
+			keyspace = ds.Keyspace
+		}
+		if !slices.Contains(result, keyspace) {
+			result = append(result, keyspace)
+		}
+	}
+	return result
+}
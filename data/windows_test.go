@@ -0,0 +1,46 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUnreleasedKeyspaces(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	released := Window{AvailableFrom: &past}
+	unreleased := Window{AvailableFrom: &future}
+	tests := []struct {
+		name     string
+		datasets Datasets
+		want     []string
+	}{
+		{
+			name:     "all released",
+			datasets: Datasets{{Keyspace: "travel-sample.inventory"}, {Keyspace: "f1._default", Window: released}},
+		},
+		{
+			name:     "own bucket",
+			datasets: Datasets{{Keyspace: "travel-sample.inventory"}, {Keyspace: "f1._default", Window: unreleased}},
+			want:     []string{"f1"},
+		},
+		{
+			name:     "bucket shared with a released dataset",
+			datasets: Datasets{{Keyspace: "travel-sample.inventory"}, {Keyspace: "travel-sample.tenants", Window: unreleased}},
+			want:     []string{"travel-sample.tenants"},
+		},
+		{
+			name:     "bucket shared with an unreleased dataset",
+			datasets: Datasets{{Keyspace: "travel-sample.inventory", Window: unreleased}, {Keyspace: "travel-sample.tenants", Window: unreleased}},
+			want:     []string{"travel-sample"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.datasets.UnreleasedKeyspaces(now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UnreleasedKeyspaces() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
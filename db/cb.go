@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/couchbase/gocb/v2"
+	"go.uber.org/multierr"
 
 	"query-adventure/cfg"
 )
@@ -23,6 +24,23 @@ func Connect(g *cfg.Globals) (*QueryConnection, *ManagementConnection, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to connect using query creds: %w", err)
 	}
+	// Used for checking data-modifying challenges. The sandbox user can't write anywhere outside the sandbox bucket,
+	// so the transactions' metadata has to go there too.
+	sandboxTxnOptions := txnOptions
+	sandboxTxnOptions.MetadataCollection = &gocb.TransactionKeyspace{
+		BucketName:     g.DB.SandboxBucket,
+		ScopeName:      "_default",
+		CollectionName: "_default",
+	}
+	sCluster, err := gocb.Connect(g.DB.ConnectionString, gocb.ClusterOptions{
+		Username:           g.DB.SandboxUsername,
+		Password:           g.DB.SandboxPassword,
+		TransactionsConfig: sandboxTxnOptions,
+	})
+	if err != nil {
+		_ = qCluster.Close(nil)
+		return nil, nil, fmt.Errorf("failed to connect using sandbox creds: %w", err)
+	}
 	mCluster, err := gocb.Connect(g.DB.ConnectionString, gocb.ClusterOptions{
 		Username:           g.DB.ManagementUsername,
 		Password:           g.DB.ManagementPassword,
@@ -30,21 +48,27 @@ func Connect(g *cfg.Globals) (*QueryConnection, *ManagementConnection, error) {
 	})
 	if err != nil {
 		_ = qCluster.Close(nil)
+		_ = sCluster.Close(nil)
 		return nil, nil, fmt.Errorf("failed to connect using management creds: %w", err)
 	}
 	q := &QueryConnection{
-		cluster:      qCluster,
-		queryTimeout: g.QueryTimeout,
+		cluster:        qCluster,
+		sandboxCluster: sCluster,
+		queryTimeout:   g.QueryTimeout,
 	}
 	mgmt := &ManagementConnection{
-		cluster: mCluster,
-		bucket:  mCluster.Bucket(g.DB.ManagementBucket),
-		s:       mCluster.Bucket(g.DB.ManagementBucket).Scope(g.DB.ManagementScope),
+		cluster:       mCluster,
+		bucket:        mCluster.Bucket(g.DB.ManagementBucket),
+		s:             mCluster.Bucket(g.DB.ManagementBucket).Scope(g.DB.ManagementScope),
+		sandboxBucket: g.DB.SandboxBucket,
 	}
 	if g.DB.ManagementInit {
 		err = mgmt.init()
+		if err == nil {
+			err = mgmt.initSandboxes(g.DB.SandboxUsername, g.DB.SandboxPassword)
+		}
 		if err != nil {
-			_ = qCluster.Close(nil)
+			_ = q.Close()
 			_ = mCluster.Close(nil)
 			return nil, nil, fmt.Errorf("failed to initialize mgmt: %w", err)
 		}
@@ -53,5 +77,5 @@ func Connect(g *cfg.Globals) (*QueryConnection, *ManagementConnection, error) {
 }
 
 func (c *QueryConnection) Close() error {
-	return c.cluster.Close(nil)
+	return multierr.Append(c.cluster.Close(nil), c.sandboxCluster.Close(nil))
 }
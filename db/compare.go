@@ -0,0 +1,409 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+
+	"query-adventure/data"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+// valuesEqual compares two decoded JSON values (at any depth) according to the challenge's verify settings.
+func valuesEqual(v data.Verify, a, b any) bool {
+	if v.Tolerance == nil && !v.MissingIsNull {
+		return reflect.DeepEqual(a, b)
+	}
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		return ok && numbersEqual(v.Tolerance, av, bv)
+	case []any:
+		bv, ok := b.([]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !valuesEqual(v, av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok {
+			return false
+		}
+		if !v.MissingIsNull && len(av) != len(bv) {
+			return false
+		}
+		for key, aField := range av {
+			bField, ok := bv[key]
+			if !ok && !(v.MissingIsNull && aField == nil) {
+				return false
+			}
+			if !valuesEqual(v, aField, bField) {
+				return false
+			}
+		}
+		if v.MissingIsNull {
+			// Catch fields that are only present (and non-null) in b.
+			for key, bField := range bv {
+				if _, ok := av[key]; !ok && bField != nil {
+					return false
+				}
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+func numbersEqual(t *data.Tolerance, a, b float64) bool {
+	if a == b {
+		return true
+	}
+	if t == nil {
+		return false
+	}
+	if t.Round != nil {
+		scale := math.Pow(10, float64(*t.Round))
+		a = math.Round(a*scale) / scale
+		b = math.Round(b*scale) / scale
+		if a == b {
+			return true
+		}
+	}
+	diff := math.Abs(a - b)
+	if diff <= t.Absolute {
+		return true
+	}
+	return diff <= t.Relative*math.Max(math.Abs(a), math.Abs(b))
+}
+
+// rowSource is a stream of result rows. *gocb.QueryResult satisfies it, as does sliceRows for rows that have already
+// been read.
+type rowSource interface {
+	Next() bool
+	Row(valuePtr any) error
+	Close() error
+}
+
+// sliceRows is a rowSource over rows that are already in memory.
+type sliceRows struct {
+	rows []any
+	pos  int
+}
+
+func newSliceRows(rows []any) *sliceRows {
+	return &sliceRows{rows: rows, pos: -1}
+}
+
+func (s *sliceRows) Next() bool {
+	if s.pos+1 >= len(s.rows) {
+		return false
+	}
+	s.pos++
+	return true
+}
+
+func (s *sliceRows) Row(valuePtr any) error {
+	ptr, ok := valuePtr.(*any)
+	if !ok {
+		return fmt.Errorf("sliceRows.Row: unsupported type %T", valuePtr)
+	}
+	*ptr = s.rows[s.pos]
+	return nil
+}
+
+func (s *sliceRows) Close() error {
+	return nil
+}
+
+func readAllRows(rs rowSource) ([]any, error) {
+	var rows []any
+	for rs.Next() {
+		var row any
+		err := rs.Row(&row)
+		if err != nil {
+			_ = rs.Close()
+			return nil, fmt.Errorf("row error: %w", err)
+		}
+		rows = append(rows, row)
+	}
+	err := rs.Close()
+	if err != nil {
+		return nil, fmt.Errorf("close error: %w", err)
+	}
+	return rows, nil
+}
+
+// verifyRows checks that the input rows match the target rows according to the verify settings, closing both sources.
+// It returns how many rows matched before the first difference, which is used to find the closest of several targets.
+func verifyRows(verify data.Verify, target, input rowSource) (uint, error) {
+	if verify.Order == data.OrderAny {
+		return verifyUnordered(verify, target, input)
+	}
+	return verifyStrict(verify, target, input)
+}
+
+func verifyStrict(verify data.Verify, targetQR, inputQR rowSource) (uint, error) {
+	var targetRows, inputRows, matched uint
+	var finalErr error
+	var targetRow, inputRow any
+	var err error
+	for targetQR.Next() {
+		targetRows++
+		err = targetQR.Row(&targetRow)
+		if err != nil {
+			finalErr = fmt.Errorf("failed to parse row from target: %w", err)
+			goto exit
+		}
+
+		ok := inputQR.Next()
+		if !ok {
+			goto notEnough
+		}
+		inputRows++
+		err = inputQR.Row(&inputRow)
+		if err != nil {
+			finalErr = fmt.Errorf("failed to parse row from input: %w", err)
+			goto exit
+		}
+
+		if !valuesEqual(verify, targetRow, inputRow) {
+			finalErr = errMismatch(inputRows, targetRow, inputRow)
+			goto exit
+		}
+		matched++
+	}
+	// Make sure the target ran out because it finished rather than because it failed part-way.
+	if err = targetQR.Close(); err != nil {
+		finalErr = fmt.Errorf("failed to read target rows: %w", err)
+		goto exit
+	}
+	if inputQR.Next() {
+		inputRows++
+		err = inputQR.Row(&inputRow)
+		if err != nil {
+			finalErr = fmt.Errorf("failed to parse row from input (in too many rows loop): %w", err)
+			goto exit
+		}
+		for inputQR.Next() {
+			inputRows++
+		}
+		if err = inputQR.Close(); err != nil {
+			finalErr = newQueryFailure(err)
+			goto exit
+		}
+		finalErr = errTooManyRows(targetRows, inputRows, targetRow, inputRow)
+		goto exit
+	}
+	if err = inputQR.Close(); err != nil {
+		finalErr = newQueryFailure(err)
+		goto exit
+	}
+	finalErr = nil
+	goto exit
+notEnough:
+	// Likewise, the input might have run out because it failed (e.g. it timed out), which isn't the same as being wrong.
+	if err = inputQR.Close(); err != nil {
+		finalErr = newQueryFailure(err)
+		goto exit
+	}
+	// Run target to the end to get the expected number
+	for targetQR.Next() {
+		targetRows++
+	}
+	if err = targetQR.Close(); err != nil {
+		finalErr = fmt.Errorf("failed to read target rows: %w", err)
+		goto exit
+	}
+	finalErr = errNotEnoughRows(targetRows, inputRows, inputRow, targetRow)
+	goto exit
+exit:
+	// Closing twice is fine, and stops whichever side is still running if we're finishing early.
+	_ = targetQR.Close()
+	_ = inputQR.Close()
+	return matched, finalErr
+}
+
+// verifyUnordered compares the results of the two queries as multisets, ignoring the order of the rows.
+func verifyUnordered(verify data.Verify, targetQR, inputQR rowSource) (uint, error) {
+	targetRows, err := readAllRows(targetQR)
+	if err != nil {
+		_ = inputQR.Close()
+		return 0, fmt.Errorf("failed to read target rows: %w", err)
+	}
+	inputRows, err := readAllRows(inputQR)
+	if err != nil {
+		return 0, newQueryFailure(err)
+	}
+	if verify.Tolerance == nil {
+		return matchRowsByKey(verify, targetRows, inputRows)
+	}
+	return matchRowsPairwise(verify, targetRows, inputRows)
+}
+
+// matchRowsByKey matches up the rows by counting them by their canonical JSON, which is only right when equal rows
+// always have the same canonical form (so not when there's a tolerance).
+func matchRowsByKey(verify data.Verify, targetRows, inputRows []any) (uint, error) {
+	counts := make(map[string]int, len(targetRows))
+	for _, row := range targetRows {
+		counts[canonicalRow(verify, row)]++
+	}
+	var matched uint
+	for _, row := range inputRows {
+		key := canonicalRow(verify, row)
+		if counts[key] == 0 {
+			return matched, errUnexpectedRow(uint(len(targetRows)), uint(len(inputRows)), row)
+		}
+		counts[key]--
+		matched++
+	}
+	// Go through the target rows rather than the map, so that the missing row reported is always the first.
+	for _, row := range targetRows {
+		if key := canonicalRow(verify, row); counts[key] > 0 {
+			return matched, errMissingRow(uint(len(targetRows)), uint(len(inputRows)), row)
+		}
+	}
+	return matched, nil
+}
+
+// canonicalRow returns a key for the row that's the same for any two rows that are equal according to the verify
+// settings, which mustn't have a tolerance. encoding/json sorts object keys, so marshalling is enough, once nulls have
+// been dropped if they're the same as MISSING.
+func canonicalRow(verify data.Verify, row any) string {
+	if verify.MissingIsNull {
+		row = dropNulls(row)
+	}
+	return string(mustMarshalJSON(row))
+}
+
+// dropNulls returns a copy of v with all the null object fields (at any depth) removed.
+func dropNulls(v any) any {
+	switch v := v.(type) {
+	case []any:
+		result := make([]any, len(v))
+		for i, elem := range v {
+			result[i] = dropNulls(elem)
+		}
+		return result
+	case map[string]any:
+		result := make(map[string]any, len(v))
+		for key, field := range v {
+			if field != nil {
+				result[key] = dropNulls(field)
+			}
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// matchRowsPairwise matches up the rows by comparing every input row with the unmatched target rows, as rows that are
+// equal within the tolerance won't necessarily have the same canonical form.
+func matchRowsPairwise(verify data.Verify, targetRows, inputRows []any) (uint, error) {
+	var matched uint
+	unmatched := make([]any, len(targetRows))
+	copy(unmatched, targetRows)
+inputLoop:
+	for _, row := range inputRows {
+		for i, candidate := range unmatched {
+			if valuesEqual(verify, candidate, row) {
+				unmatched = append(unmatched[:i], unmatched[i+1:]...)
+				matched++
+				continue inputLoop
+			}
+		}
+		return matched, errUnexpectedRow(uint(len(targetRows)), uint(len(inputRows)), row)
+	}
+	if len(unmatched) > 0 {
+		return matched, errMissingRow(uint(len(targetRows)), uint(len(inputRows)), unmatched[0])
+	}
+	return matched, nil
+}
+
+// prefetchBuffer is how many rows prefetchRows reads ahead of the consumer.
+const prefetchBuffer = 64
+
+// prefetchedRows is a rowSource that reads rows from another rowSource on a separate goroutine, so that both sides of
+// a comparison keep streaming in parallel rather than only advancing when the comparison asks for the next row.
+type prefetchedRows struct {
+	src    rowSource
+	cancel context.CancelFunc
+	rows   chan json.RawMessage
+	stop   chan struct{}
+	done   chan struct{}
+	cur    json.RawMessage
+	err    error
+	// closeOnce makes Close safe to call more than once, with closeErr being what it returns every time.
+	closeOnce sync.Once
+	closeErr  error
+	// meta is the query's metadata, if src is a query result and it was read to the end.
+	meta *gocb.QueryMetaData
+}
+
+// prefetchRows starts reading src in the background. cancel should cancel the context of the query behind src, and
+// is called when the prefetchedRows is closed, so that closing it early stops the query.
+func prefetchRows(src rowSource, cancel context.CancelFunc) *prefetchedRows {
+	p := &prefetchedRows{
+		src:    src,
+		cancel: cancel,
+		rows:   make(chan json.RawMessage, prefetchBuffer),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *prefetchedRows) run() {
+	defer close(p.done)
+	defer close(p.rows)
+	for p.src.Next() {
+		var row json.RawMessage
+		if err := p.src.Row(&row); err != nil {
+			p.err = err
+			return
+		}
+		select {
+		case p.rows <- row:
+		case <-p.stop:
+			return
+		}
+	}
+	if qr, ok := p.src.(*gocb.QueryResult); ok {
+		// Only available once all the rows have been read.
+		p.meta, _ = qr.MetaData()
+	}
+}
+
+func (p *prefetchedRows) Next() bool {
+	row, ok := <-p.rows
+	p.cur = row
+	return ok
+}
+
+func (p *prefetchedRows) Row(valuePtr any) error {
+	return json.Unmarshal(p.cur, valuePtr)
+}
+
+func (p *prefetchedRows) Close() error {
+	p.closeOnce.Do(func() {
+		p.cancel()
+		close(p.stop)
+		<-p.done
+		p.closeErr = p.src.Close()
+		if p.err != nil {
+			p.closeErr = p.err
+		}
+	})
+	return p.closeErr
+}
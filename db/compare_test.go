@@ -0,0 +1,393 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"query-adventure/data"
+)
+
+// jsonRows decodes a JSON array of rows the same way query results are decoded.
+func jsonRows(t *testing.T, rows string) []any {
+	t.Helper()
+	var result []any
+	if err := json.Unmarshal([]byte(rows), &result); err != nil {
+		t.Fatalf("bad test rows %s: %v", rows, err)
+	}
+	return result
+}
+
+// checkVerifyResult fails the test if err isn't a VerifyError with the wanted message, or isn't nil when ok is set.
+func checkVerifyResult(t *testing.T, err error, ok bool, wantMsg verifyMessage) {
+	t.Helper()
+	if ok {
+		if err != nil {
+			t.Errorf("got error %v, want none", err)
+		}
+		return
+	}
+	var verifyErr *VerifyError
+	if !errors.As(err, &verifyErr) {
+		t.Fatalf("got error %v, want a VerifyError", err)
+	}
+	if verifyErr.msg != wantMsg {
+		t.Errorf("got %q, want message %d", verifyErr.Error(), wantMsg)
+	}
+}
+
+func TestVerifyStrict(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		input       string
+		ok          bool
+		wantMsg     verifyMessage
+		wantMatched uint
+	}{
+		{name: "same", target: `[{"a":1},{"a":2}]`, input: `[{"a":1},{"a":2}]`, ok: true, wantMatched: 2},
+		{name: "both empty", target: `[]`, input: `[]`, ok: true},
+		{name: "wrong order", target: `[{"a":1},{"a":2}]`, input: `[{"a":2},{"a":1}]`, wantMsg: msgMismatch},
+		{name: "mismatch after matches", target: `[1,2,3]`, input: `[1,2,4]`, wantMsg: msgMismatch, wantMatched: 2},
+		{name: "not enough rows", target: `[1,2,3]`, input: `[1,2]`, wantMsg: msgNotEnoughRows, wantMatched: 2},
+		{name: "too many rows", target: `[1,2]`, input: `[1,2,3,4]`, wantMsg: msgTooManyRows, wantMatched: 2},
+		{name: "missing field", target: `[{"a":1,"b":null}]`, input: `[{"a":1}]`, wantMsg: msgMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newSliceRows(jsonRows(t, tt.target))
+			input := newSliceRows(jsonRows(t, tt.input))
+			matched, err := verifyRows(data.Verify{Order: data.OrderStrict}, target, input)
+			checkVerifyResult(t, err, tt.ok, tt.wantMsg)
+			if matched != tt.wantMatched {
+				t.Errorf("matched %d rows, want %d", matched, tt.wantMatched)
+			}
+		})
+	}
+}
+
+func TestVerifyUnordered(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		input   string
+		ok      bool
+		wantMsg verifyMessage
+	}{
+		{name: "same order", target: `[{"a":1},{"a":2}]`, input: `[{"a":1},{"a":2}]`, ok: true},
+		{name: "different order", target: `[{"a":1},{"a":2},{"a":3}]`, input: `[{"a":3},{"a":1},{"a":2}]`, ok: true},
+		{name: "field order doesn't matter", target: `[{"a":1,"b":2}]`, input: `[{"b":2,"a":1}]`, ok: true},
+		{name: "duplicates", target: `[1,1,2]`, input: `[1,2,1]`, ok: true},
+		{name: "too few duplicates", target: `[1,1,2]`, input: `[1,2]`, wantMsg: msgMissingRow},
+		{name: "too many duplicates", target: `[1,2]`, input: `[1,1,2]`, wantMsg: msgUnexpectedRow},
+		{name: "unexpected row", target: `[{"a":1},{"a":2}]`, input: `[{"a":1},{"a":3}]`, wantMsg: msgUnexpectedRow},
+		{name: "missing row", target: `[{"a":1},{"a":2}]`, input: `[{"a":2}]`, wantMsg: msgMissingRow},
+		{name: "int and float are the same number", target: `[1]`, input: `[1.0]`, ok: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newSliceRows(jsonRows(t, tt.target))
+			input := newSliceRows(jsonRows(t, tt.input))
+			_, err := verifyRows(data.Verify{Order: data.OrderAny}, target, input)
+			checkVerifyResult(t, err, tt.ok, tt.wantMsg)
+		})
+	}
+}
+
+// TestMatchRowsByKeyReportsFirstMissing checks that the missing row reported is the first one in the target's order,
+// rather than whichever the map happens to give first.
+func TestMatchRowsByKeyReportsFirstMissing(t *testing.T) {
+	target := jsonRows(t, `[{"a":1},{"a":2},{"a":3},{"a":4},{"a":5}]`)
+	input := jsonRows(t, `[{"a":1}]`)
+	for i := 0; i < 20; i++ {
+		_, err := matchRowsByKey(data.Verify{}, target, input)
+		checkVerifyResult(t, err, false, msgMissingRow)
+		var verifyErr *VerifyError
+		if errors.As(err, &verifyErr) && string(verifyErr.args[2].([]byte)) != `{"a":2}` {
+			t.Fatalf("reported %s missing, want {\"a\":2}", verifyErr.args[2])
+		}
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestNumbersEqual(t *testing.T) {
+	tests := []struct {
+		name      string
+		tolerance *data.Tolerance
+		a, b      float64
+		want      bool
+	}{
+		{name: "equal, no tolerance", a: 1.5, b: 1.5, want: true},
+		{name: "tiny difference, no tolerance", a: 0.30000000000000004, b: 0.3, want: false},
+		{name: "within absolute", tolerance: &data.Tolerance{Absolute: 0.01}, a: 1.005, b: 1.0, want: true},
+		{name: "on absolute boundary", tolerance: &data.Tolerance{Absolute: 0.5}, a: 1.5, b: 1.0, want: true},
+		{name: "outside absolute", tolerance: &data.Tolerance{Absolute: 0.01}, a: 1.02, b: 1.0, want: false},
+		{name: "within relative", tolerance: &data.Tolerance{Relative: 0.01}, a: 1000, b: 1009, want: true},
+		{name: "outside relative", tolerance: &data.Tolerance{Relative: 0.01}, a: 1000, b: 1011, want: false},
+		{name: "relative uses the bigger side", tolerance: &data.Tolerance{Relative: 0.1}, a: 100, b: 110, want: true},
+		{name: "relative near zero", tolerance: &data.Tolerance{Relative: 0.01}, a: 0, b: 0.001, want: false},
+		{name: "either epsilon is enough", tolerance: &data.Tolerance{Absolute: 0.5, Relative: 0.001}, a: 1.4, b: 1, want: true},
+		{name: "rounded equal", tolerance: &data.Tolerance{Round: intPtr(2)}, a: 3.14159, b: 3.1428, want: true},
+		{name: "rounded different", tolerance: &data.Tolerance{Round: intPtr(2)}, a: 3.14159, b: 3.146, want: false},
+		{name: "rounded to integers", tolerance: &data.Tolerance{Round: intPtr(0)}, a: 2.4, b: 1.6, want: true},
+		{name: "absolute applies after rounding", tolerance: &data.Tolerance{Round: intPtr(1), Absolute: 0.05}, a: 1.04, b: 1.06, want: false},
+		{name: "negative numbers", tolerance: &data.Tolerance{Relative: 0.01}, a: -1000, b: -1005, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := numbersEqual(tt.tolerance, tt.a, tt.b); got != tt.want {
+				t.Errorf("numbersEqual(%v, %v) = %t, want %t", tt.a, tt.b, got, tt.want)
+			}
+			if got := numbersEqual(tt.tolerance, tt.b, tt.a); got != tt.want {
+				t.Errorf("numbersEqual(%v, %v) = %t, want %t", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValuesEqual(t *testing.T) {
+	tolerant := data.Verify{Tolerance: &data.Tolerance{Absolute: 0.01}}
+	missingIsNull := data.Verify{MissingIsNull: true}
+	tests := []struct {
+		name   string
+		verify data.Verify
+		a, b   string
+		want   bool
+	}{
+		{name: "exact", a: `{"a":[1,"x",null]}`, b: `{"a":[1,"x",null]}`, want: true},
+		{name: "exact, different number", a: `{"a":1.001}`, b: `{"a":1}`, want: false},
+		{name: "tolerance at top level", verify: tolerant, a: `1.001`, b: `1`, want: true},
+		{name: "tolerance in an object", verify: tolerant, a: `{"avg":1.001}`, b: `{"avg":1}`, want: true},
+		{name: "tolerance deep in arrays", verify: tolerant, a: `{"a":[[1.001],{"b":2.005}]}`, b: `{"a":[[1],{"b":2}]}`, want: true},
+		{name: "tolerance exceeded deep", verify: tolerant, a: `{"a":[[1.1]]}`, b: `{"a":[[1]]}`, want: false},
+		{name: "tolerance doesn't cross types", verify: tolerant, a: `{"a":"1"}`, b: `{"a":1}`, want: false},
+		{name: "tolerance with different lengths", verify: tolerant, a: `[1,2]`, b: `[1,2,3]`, want: false},
+		{name: "tolerance with extra field", verify: tolerant, a: `{"a":1}`, b: `{"a":1,"b":2}`, want: false},
+		{name: "tolerance with strings", verify: tolerant, a: `{"a":"x"}`, b: `{"a":"x"}`, want: true},
+		{name: "missing vs null, strict", a: `{"a":1,"b":null}`, b: `{"a":1}`, want: false},
+		{name: "missing vs null", verify: missingIsNull, a: `{"a":1,"b":null}`, b: `{"a":1}`, want: true},
+		{name: "null vs missing", verify: missingIsNull, a: `{"a":1}`, b: `{"a":1,"b":null}`, want: true},
+		{name: "missing vs value", verify: missingIsNull, a: `{"a":1,"b":2}`, b: `{"a":1}`, want: false},
+		{name: "value vs missing", verify: missingIsNull, a: `{"a":1}`, b: `{"a":1,"b":2}`, want: false},
+		{name: "missing vs null, nested", verify: missingIsNull, a: `{"a":[{"b":null}]}`, b: `{"a":[{}]}`, want: true},
+		{name: "null array elements still count", verify: missingIsNull, a: `[null]`, b: `[]`, want: false},
+		{name: "null vs missing top-level field value", verify: missingIsNull, a: `{"a":null}`, b: `{"a":0}`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a, b any
+			if err := json.Unmarshal([]byte(tt.a), &a); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.b), &b); err != nil {
+				t.Fatal(err)
+			}
+			if got := valuesEqual(tt.verify, a, b); got != tt.want {
+				t.Errorf("valuesEqual(%s, %s) = %t, want %t", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyUnorderedWithSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		verify  data.Verify
+		target  string
+		input   string
+		ok      bool
+		wantMsg verifyMessage
+	}{
+		{
+			name:   "tolerance, different order",
+			verify: data.Verify{Order: data.OrderAny, Tolerance: &data.Tolerance{Absolute: 0.01}},
+			target: `[{"avg":1.001},{"avg":2}]`,
+			input:  `[{"avg":2.002},{"avg":1}]`,
+			ok:     true,
+		},
+		{
+			name:    "tolerance exceeded",
+			verify:  data.Verify{Order: data.OrderAny, Tolerance: &data.Tolerance{Absolute: 0.01}},
+			target:  `[{"avg":1},{"avg":2}]`,
+			input:   `[{"avg":2},{"avg":1.5}]`,
+			wantMsg: msgUnexpectedRow,
+		},
+		{
+			// Each input row must use up its own target row, even when it's within the tolerance of several.
+			name:    "tolerance doesn't match one target twice",
+			verify:  data.Verify{Order: data.OrderAny, Tolerance: &data.Tolerance{Absolute: 0.5}},
+			target:  `[1,3]`,
+			input:   `[1.1,1.2]`,
+			wantMsg: msgUnexpectedRow,
+		},
+		{
+			name:   "missing is null, different order",
+			verify: data.Verify{Order: data.OrderAny, MissingIsNull: true},
+			target: `[{"a":1,"b":null},{"a":2}]`,
+			input:  `[{"a":2,"b":null},{"a":1}]`,
+			ok:     true,
+		},
+		{
+			name:    "missing is null, value differs",
+			verify:  data.Verify{Order: data.OrderAny, MissingIsNull: true},
+			target:  `[{"a":1,"b":null}]`,
+			input:   `[{"a":1,"b":2}]`,
+			wantMsg: msgUnexpectedRow,
+		},
+		{
+			name:   "strict order with tolerance",
+			verify: data.Verify{Order: data.OrderStrict, Tolerance: &data.Tolerance{Relative: 0.01}},
+			target: `[100,200]`,
+			input:  `[100.5,199]`,
+			ok:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newSliceRows(jsonRows(t, tt.target))
+			input := newSliceRows(jsonRows(t, tt.input))
+			_, err := verifyRows(tt.verify, target, input)
+			checkVerifyResult(t, err, tt.ok, tt.wantMsg)
+		})
+	}
+}
+
+// rawRows is a rowSource over rows of raw JSON, which it can decode into anything, like a query result.
+type rawRows struct {
+	rows []string
+	pos  int
+	// rowErrAt is the index of a row that fails to decode, or -1.
+	rowErrAt int
+	closeErr error
+	closes   int
+}
+
+func newRawRows(n int) *rawRows {
+	r := &rawRows{pos: -1, rowErrAt: -1}
+	for i := 0; i < n; i++ {
+		r.rows = append(r.rows, fmt.Sprintf(`{"n":%d}`, i))
+	}
+	return r
+}
+
+func (r *rawRows) Next() bool {
+	if r.pos+1 >= len(r.rows) {
+		return false
+	}
+	r.pos++
+	return true
+}
+
+func (r *rawRows) Row(valuePtr any) error {
+	if r.pos == r.rowErrAt {
+		return errors.New("bad row")
+	}
+	return json.Unmarshal([]byte(r.rows[r.pos]), valuePtr)
+}
+
+func (r *rawRows) Close() error {
+	r.closes++
+	return r.closeErr
+}
+
+func TestPrefetchRows(t *testing.T) {
+	errClose := errors.New("close failed")
+	tests := []struct {
+		name string
+		rows int
+		// readRows is how many rows to read before closing, or -1 to read them all.
+		readRows int
+		rowErrAt int
+		closeErr error
+		wantRows int
+		wantErr  error
+	}{
+		{name: "empty", rows: 0, readRows: -1, rowErrAt: -1},
+		{name: "all rows", rows: 10, readRows: -1, rowErrAt: -1, wantRows: 10},
+		{name: "more rows than the buffer", rows: prefetchBuffer * 3, readRows: -1, rowErrAt: -1, wantRows: prefetchBuffer * 3},
+		{name: "closed early", rows: 10, readRows: 3, rowErrAt: -1, wantRows: 3},
+		// The reader is blocked on a full buffer, so closing has to stop it rather than wait for it to finish.
+		{name: "closed early with a full buffer", rows: prefetchBuffer * 10, readRows: 1, rowErrAt: -1, wantRows: 1},
+		{name: "close error", rows: 5, readRows: -1, rowErrAt: -1, closeErr: errClose, wantRows: 5, wantErr: errClose},
+		{name: "row error", rows: 5, readRows: -1, rowErrAt: 2, wantRows: 2, wantErr: errors.New("bad row")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := newRawRows(tt.rows)
+			src.rowErrAt = tt.rowErrAt
+			src.closeErr = tt.closeErr
+			cancels := 0
+			p := prefetchRows(src, func() { cancels++ })
+
+			var got []any
+			for (tt.readRows < 0 || len(got) < tt.readRows) && p.Next() {
+				var row any
+				if err := p.Row(&row); err != nil {
+					t.Fatalf("row error: %v", err)
+				}
+				got = append(got, row)
+			}
+			closeDone := make(chan error)
+			go func() {
+				closeDone <- p.Close()
+			}()
+			var err error
+			select {
+			case err = <-closeDone:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Close didn't return")
+			}
+
+			if len(got) != tt.wantRows {
+				t.Errorf("got %d rows, want %d", len(got), tt.wantRows)
+			}
+			for i, row := range got {
+				if n := row.(map[string]any)["n"]; n != float64(i) {
+					t.Errorf("row %d is %v, want %d", i, n, i)
+				}
+			}
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.wantErr != nil && (err == nil || err.Error() != tt.wantErr.Error()):
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+			if cancels != 1 {
+				t.Errorf("query cancelled %d times, want once", cancels)
+			}
+			if src.closes != 1 {
+				t.Errorf("source closed %d times, want once", src.closes)
+			}
+
+			// Closing again is what verifyStrict does on the way out, and mustn't close the source again.
+			if err2 := p.Close(); err2 != err {
+				t.Errorf("second Close returned %v, want %v", err2, err)
+			}
+			if cancels != 1 || src.closes != 1 {
+				t.Errorf("second Close cancelled %d times and closed %d times, want once each", cancels, src.closes)
+			}
+		})
+	}
+}
+
+// TestVerifyStreamingStopsEarly checks that a mismatch on the first row stops both sides of a streamed comparison,
+// rather than reading them to the end.
+func TestVerifyStreamingStopsEarly(t *testing.T) {
+	target := newRawRows(prefetchBuffer * 10)
+	input := newRawRows(prefetchBuffer * 10)
+	input.rows[0] = `{"n":"wrong"}`
+	var targetCancels, inputCancels int
+	_, err := verifyRows(data.Verify{}, prefetchRows(target, func() { targetCancels++ }), prefetchRows(input, func() { inputCancels++ }))
+	checkVerifyResult(t, err, false, msgMismatch)
+	if targetCancels != 1 || inputCancels != 1 {
+		t.Errorf("cancelled target %d and input %d times, want once each", targetCancels, inputCancels)
+	}
+	if target.pos >= len(target.rows)-1 || input.pos >= len(input.rows)-1 {
+		t.Errorf("read target to row %d and input to row %d, want both stopped early", target.pos, input.pos)
+	}
+}
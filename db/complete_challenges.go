@@ -24,16 +24,37 @@ type CompleteChallenge struct {
 	RawQuery    string    `json:"raw_query"`
 	RawPoints   uint      `json:"raw_points"`
 	HintsUsed   uint      `json:"hints_used"`
-	First       bool      `json:"first"`
-	FinalPoints float64   `json:"points"`
+	// Hints are the indexes of the hints used, so that the points can be recalculated if their costs change.
+	Hints       []int   `json:"hints"`
+	First       bool    `json:"first"`
+	FinalPoints float64 `json:"points"`
+	// Metrics are the submitted query's execution metrics, which performance challenges are scored on.
+	Metrics *QueryMetrics `json:"metrics,omitempty"`
 }
 
-func (cc *CompleteChallenge) calculateFinalPoints(g *cfg.Globals) {
+func (cc *CompleteChallenge) calculateFinalPoints(g *cfg.Globals, query data.Query) {
 	base := float64(cc.RawPoints)
-	base *= math.Pow(g.ScoreHintMultiplier, float64(cc.HintsUsed))
+	switch {
+	case query.Performance != nil && cc.Metrics != nil:
+		base *= query.Performance.Multiplier(cc.Metrics.ElapsedTime, cc.Metrics.DocumentsFetched, cc.Metrics.PrimaryScan)
+	case query.Performance != nil:
+		// There's no telling how efficient the query was, so it can't score more than the least efficient one.
+		base *= query.Performance.WorstMultiplier()
+	}
+	var deduction float64
+	for _, idx := range cc.Hints {
+		if idx < 0 || idx >= len(query.Hints) {
+			// The hint has since been removed from the challenge - fall back to the default cost.
+			base *= g.ScoreHintMultiplier
+			continue
+		}
+		base = query.Hints[idx].Apply(base, g.ScoreHintMultiplier)
+		deduction += query.Hints[idx].Deduction
+	}
 	if cc.First {
 		base *= g.ScoreFirstTeamMultiplier
 	}
+	base = math.Max(base-deduction, 0)
 	cc.FinalPoints = math.Round(base*10) / 10
 }
 
@@ -41,7 +62,7 @@ func completeChallengeDocKey(teamID, datasetID, queryID string) string {
 	return fmt.Sprintf("%s::%s::%s", teamID, datasetID, queryID)
 }
 
-func (m *ManagementConnection) CompleteChallenge(ctx context.Context, g *cfg.Globals, dataset data.Dataset, query data.Query, team Team, email string, rawQuery string, hintsUsed uint) (CompleteChallenge, error) {
+func (m *ManagementConnection) CompleteChallenge(ctx context.Context, g *cfg.Globals, dataset data.Dataset, query data.Query, team Team, email string, rawQuery string, hints UsedHints, metrics *QueryMetrics) (CompleteChallenge, error) {
 	now := time.Now()
 	var cc CompleteChallenge
 	_, err := m.cluster.Transactions().Run(func(tx *gocb.TransactionAttemptContext) error {
@@ -53,8 +74,10 @@ func (m *ManagementConnection) CompleteChallenge(ctx context.Context, g *cfg.Glo
 			CompletedAt: now,
 			RawQuery:    rawQuery,
 			RawPoints:   query.Points,
-			HintsUsed:   hintsUsed,
+			HintsUsed:   uint(len(hints)),
+			Hints:       hints.Indexes(),
 			First:       false,
+			Metrics:     metrics,
 		}
 		// Check if other teams have completed it
 		qr, err := tx.Query(fmt.Sprintf("SELECT COUNT(*) AS count FROM `%s`.`%s`.`%s` WHERE dataset_id = $1 AND query_id = $2 AND team_id = $3", m.bucket.Name(), m.s.Name(), cCompletedChallenges), &gocb.TransactionQueryOptions{
@@ -71,7 +94,7 @@ func (m *ManagementConnection) CompleteChallenge(ctx context.Context, g *cfg.Glo
 			return fmt.Errorf("failed to parse other team query result: %w", err)
 		}
 		cc.First = result.Count == 0
-		cc.calculateFinalPoints(g)
+		cc.calculateFinalPoints(g, query)
 		id := completeChallengeDocKey(team.ID, dataset.ID, query.ID)
 		_, err = tx.Insert(m.s.Collection(cCompletedChallenges), id, cc)
 		if errors.Is(err, gocb.ErrDocumentExists) {
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"query-adventure/cfg"
+	"query-adventure/data"
+)
+
+func TestCalculateFinalPointsPerformance(t *testing.T) {
+	g := &cfg.Globals{ScoreHintMultiplier: 0.95, ScoreFirstTeamMultiplier: 1.1}
+	primaryScan := 0.8
+	performance := &data.Performance{
+		Elapsed:               &data.DurationThreshold{Full: 10 * time.Millisecond, Worst: 110 * time.Millisecond, MinMultiplier: 0.5},
+		PrimaryScanMultiplier: &primaryScan,
+	}
+	tests := []struct {
+		name        string
+		performance *data.Performance
+		metrics     *QueryMetrics
+		want        float64
+	}{
+		{name: "not a performance challenge", metrics: &QueryMetrics{ElapsedTime: time.Second, PrimaryScan: true}, want: 100},
+		{name: "not a performance challenge, no metrics", want: 100},
+		{name: "fast", performance: performance, metrics: &QueryMetrics{ElapsedTime: 5 * time.Millisecond}, want: 100},
+		{name: "half way", performance: performance, metrics: &QueryMetrics{ElapsedTime: 60 * time.Millisecond}, want: 75},
+		{name: "slow with a primary scan", performance: performance, metrics: &QueryMetrics{ElapsedTime: time.Second, PrimaryScan: true}, want: 40},
+		{name: "no metrics", performance: performance, want: 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := CompleteChallenge{RawPoints: 100, Metrics: tt.metrics}
+			cc.calculateFinalPoints(g, data.Query{Points: 100, Performance: tt.performance})
+			if cc.FinalPoints != tt.want {
+				t.Errorf("got %v points, want %v", cc.FinalPoints, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/couchbase/gocb/v2"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// QueryPlan is the query service's plan for a statement, along with a summary of the parts players most often need.
+type QueryPlan struct {
+	Plan any `json:"plan"`
+	// Indexes are the indexes the plan scans. The primary index shows as #primary, or its name if it has one.
+	Indexes     []string `json:"indexes"`
+	PrimaryScan bool     `json:"primary_scan"`
+	// Cost and Cardinality are the cost-based optimizer's estimates, which are only there if the keyspace has
+	// statistics.
+	Cost        *float64 `json:"cost,omitempty"`
+	Cardinality *float64 `json:"cardinality,omitempty"`
+}
+
+// Explain returns the plan for the statement, which shouldn't already start with EXPLAIN. If sandbox is set, keyspace
+// must be a sandbox, and the statement is explained as the sandbox user.
+func (c *QueryConnection) Explain(ctx context.Context, keyspace, stmt string, sandbox bool) (*QueryPlan, error) {
+	scope := c.scope
+	if sandbox {
+		scope = c.sandboxScope
+	}
+	ks, err := scope(keyspace)
+	if err != nil {
+		return nil, err
+	}
+	qr, err := ks.Query("EXPLAIN "+stmt, &gocb.QueryOptions{
+		Context:  ctx,
+		Adhoc:    true,
+		Timeout:  c.queryTimeout,
+		Readonly: true,
+	})
+	if err != nil {
+		return nil, newQueryFailure(err)
+	}
+	var row map[string]any
+	err = qr.One(&row)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan: %w", err)
+	}
+	result := &QueryPlan{
+		Plan:    row["plan"],
+		Indexes: make([]string, 0),
+	}
+	result.Cost = number(row["cost"])
+	result.Cardinality = number(row["cardinality"])
+	if root, ok := result.Plan.(map[string]any); ok && result.Cost == nil {
+		// Older versions only have the estimates on the operators.
+		if estimates, ok := root["optimizer_estimates"].(map[string]any); ok {
+			result.Cost = number(estimates["cost"])
+			result.Cardinality = number(estimates["cardinality"])
+		}
+	}
+	summarizePlan(result.Plan, result)
+	return result, nil
+}
+
+// summarizePlan walks the plan tree, recording the scans it finds in result.
+func summarizePlan(node any, result *QueryPlan) {
+	switch n := node.(type) {
+	case map[string]any:
+		if op, _ := n["#operator"].(string); strings.Contains(op, "Scan") {
+			if strings.HasPrefix(op, "PrimaryScan") {
+				result.PrimaryScan = true
+			}
+			if index, ok := n["index"].(string); ok && !slices.Contains(result.Indexes, index) {
+				result.Indexes = append(result.Indexes, index)
+			}
+		}
+		// Go through the fields in a fixed order, so that the indexes always come out the same way.
+		keys := maps.Keys(n)
+		slices.Sort(keys)
+		for _, key := range keys {
+			summarizePlan(n[key], result)
+		}
+	case []any:
+		for _, child := range n {
+			summarizePlan(child, result)
+		}
+	}
+}
+
+func number(v any) *float64 {
+	f, ok := v.(float64)
+	if !ok {
+		return nil
+	}
+	return &f
+}
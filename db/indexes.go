@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"query-adventure/data"
+
+	"github.com/couchbase/gocb/v2"
+	"golang.org/x/exp/slices"
+)
+
+// IndexState is how a dataset's declared index compares to what's actually on the cluster.
+type IndexState string
+
+const (
+	IndexOK      IndexState = "ok"
+	IndexMissing IndexState = "missing"
+	// IndexDrifted means there's an index with the declared name, but its definition is different.
+	IndexDrifted IndexState = "drifted"
+	// IndexNotBuilt means the index exists but isn't online yet, either because it's still building or because it was
+	// created with defer_build and never built.
+	IndexNotBuilt IndexState = "not_built"
+)
+
+type IndexStatus struct {
+	Dataset    string     `json:"dataset"`
+	Name       string     `json:"name"`
+	Collection string     `json:"collection"`
+	State      IndexState `json:"state"`
+	Detail     string     `json:"detail,omitempty"`
+}
+
+// EnsureDatasetIndexes creates any of the dataset's declared indexes that don't exist yet, then builds them together.
+// Existing indexes are left alone, even if they've drifted - use DatasetIndexReport to find those.
+func (m *ManagementConnection) EnsureDatasetIndexes(ds data.Dataset) error {
+	if len(ds.Indexes) == 0 {
+		return nil
+	}
+	bucket, scope, ok := strings.Cut(ds.Keyspace, ".")
+	if !ok {
+		return fmt.Errorf("invalid keyspace %q", ds.Keyspace)
+	}
+	stmts := make([]string, len(ds.Indexes))
+	var collections []string
+	for i, idx := range ds.Indexes {
+		stmts[i] = idx.CreateStatement()
+		if !slices.Contains(collections, idx.Collection) {
+			collections = append(collections, idx.Collection)
+		}
+	}
+	created, err := createDeferredIndexes(m.cluster.Bucket(bucket).Scope(scope), stmts)
+	if err != nil {
+		return fmt.Errorf("dataset %q: %w", ds.ID, err)
+	}
+	if created == 0 {
+		return nil
+	}
+	log.Printf("Building %d indexes for dataset %q", created, ds.ID)
+	return buildDeferredIndexes(m.cluster, bucket, scope, collections)
+}
+
+// DatasetIndexReport compares the dataset's declared indexes with the ones on the cluster.
+func (m *ManagementConnection) DatasetIndexReport(ctx context.Context, ds data.Dataset) ([]IndexStatus, error) {
+	bucket, scope, ok := strings.Cut(ds.Keyspace, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid keyspace %q", ds.Keyspace)
+	}
+	existing := make(map[string]map[string]gocb.QueryIndex)
+	result := make([]IndexStatus, 0, len(ds.Indexes))
+	for _, idx := range ds.Indexes {
+		byName, ok := existing[idx.Collection]
+		if !ok {
+			all, err := m.cluster.QueryIndexes().GetAllIndexes(bucket, &gocb.GetAllQueryIndexesOptions{
+				ScopeName:      scope,
+				CollectionName: idx.Collection,
+				Context:        ctx,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to list indexes on %s.%s: %w", ds.Keyspace, idx.Collection, err)
+			}
+			byName = make(map[string]gocb.QueryIndex, len(all))
+			for _, qi := range all {
+				byName[qi.Name] = qi
+			}
+			existing[idx.Collection] = byName
+		}
+		status := IndexStatus{Dataset: ds.ID, Name: idx.Name, Collection: idx.Collection}
+		if qi, ok := byName[idx.Name]; ok {
+			status.State, status.Detail = compareIndex(idx, qi)
+		} else {
+			status.State = IndexMissing
+		}
+		result = append(result, status)
+	}
+	return result, nil
+}
+
+func compareIndex(want data.Index, got gocb.QueryIndex) (IndexState, string) {
+	if want.Primary != got.IsPrimary {
+		return IndexDrifted, fmt.Sprintf("primary is %t, expected %t", got.IsPrimary, want.Primary)
+	}
+	wantKeys := make([]string, len(want.Keys))
+	for i, k := range want.Keys {
+		wantKeys[i] = normalizeIndexExpr(k)
+	}
+	gotKeys := make([]string, len(got.IndexKey))
+	for i, k := range got.IndexKey {
+		gotKeys[i] = normalizeIndexExpr(k)
+	}
+	if !slices.Equal(wantKeys, gotKeys) {
+		return IndexDrifted, fmt.Sprintf("keys are %v, expected %v", got.IndexKey, want.Keys)
+	}
+	if normalizeIndexExpr(want.Where) != normalizeIndexExpr(got.Condition) {
+		return IndexDrifted, fmt.Sprintf("condition is %q, expected %q", got.Condition, want.Where)
+	}
+	if got.State != "online" {
+		return IndexNotBuilt, fmt.Sprintf("state is %q", got.State)
+	}
+	return IndexOK, ""
+}
+
+// normalizeIndexExpr strips the things that the query service adds when it echoes an index definition back (backticks
+// around identifiers, extra parentheses and whitespace), so that it can be compared to the one in datasets.yml. It's
+// not a real parser, so some equivalent expressions written differently will still show as drifted.
+func normalizeIndexExpr(expr string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '`', '(', ')', ' ', '\t', '\n', '\r':
+			return -1
+		}
+		return r
+	}, expr)
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"query-adventure/data"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+// LoadOptions controls how LoadDataset creates and fills a dataset's keyspace.
+type LoadOptions struct {
+	// BaseDir is what relative source file paths are taken relative to.
+	BaseDir string
+	// Concurrency is how many upserts to have in flight at once.
+	Concurrency int
+	// CreateBucket creates the dataset's bucket if it doesn't exist. Turn it off for clusters (like Capella) where
+	// buckets can't be created through the SDK.
+	CreateBucket bool
+}
+
+const (
+	defaultLoadBucketQuotaMB = 256
+	loadBucketReadyTimeout   = 30 * time.Second
+	loadProgressInterval     = 10 * time.Second
+)
+
+// LoadDataset creates the dataset's bucket, scope and collections as needed, then upserts all the documents from its
+// source into them.
+func (m *ManagementConnection) LoadDataset(ctx context.Context, ds data.Dataset, opts LoadOptions) error {
+	if ds.Source == nil {
+		return fmt.Errorf("dataset %q has no source", ds.ID)
+	}
+	bucketName, scopeName, ok := strings.Cut(ds.Keyspace, ".")
+	if !ok {
+		return fmt.Errorf("invalid keyspace %q", ds.Keyspace)
+	}
+	if opts.CreateBucket {
+		if err := m.createBucket(bucketName, ds.Source.Bucket); err != nil {
+			return err
+		}
+	}
+	bucket := m.cluster.Bucket(bucketName)
+	if err := bucket.WaitUntilReady(loadBucketReadyTimeout, nil); err != nil {
+		return fmt.Errorf("bucket %q not ready: %w", bucketName, err)
+	}
+	if err := createScopeAndCollections(bucket, scopeName, ds.Source.Collections); err != nil {
+		return err
+	}
+	for _, cs := range ds.Source.Collections {
+		log.Printf("Loading %s into %s.%s", cs.File, ds.Keyspace, cs.Collection)
+		coll := bucket.Scope(scopeName).Collection(cs.Collection)
+		n, err := upsertAll(ctx, coll, cs, opts)
+		if err != nil {
+			return fmt.Errorf("failed to load %s.%s: %w", ds.Keyspace, cs.Collection, err)
+		}
+		log.Printf("Loaded %d documents into %s.%s", n, ds.Keyspace, cs.Collection)
+	}
+	return nil
+}
+
+func (m *ManagementConnection) createBucket(name string, src data.BucketSource) error {
+	settings := gocb.CreateBucketSettings{
+		BucketSettings: gocb.BucketSettings{
+			Name:           name,
+			BucketType:     gocb.CouchbaseBucketType,
+			RAMQuotaMB:     src.RAMQuotaMB,
+			NumReplicas:    src.Replicas,
+			StorageBackend: gocb.StorageBackend(src.StorageBackend),
+		},
+	}
+	if settings.RAMQuotaMB == 0 {
+		settings.RAMQuotaMB = defaultLoadBucketQuotaMB
+	}
+	if settings.StorageBackend == "" {
+		settings.StorageBackend = gocb.StorageBackendCouchstore
+	}
+	err := m.cluster.Buckets().CreateBucket(settings, nil)
+	if errors.Is(err, gocb.ErrBucketExists) {
+		log.Printf("Bucket %q already exists, skipping creation", name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %q: %w", name, err)
+	}
+	log.Printf("Created bucket %q", name)
+	return nil
+}
+
+func createScopeAndCollections(bucket *gocb.Bucket, scopeName string, sources []data.CollectionSource) error {
+	if scopeName != "_default" {
+		err := bucket.Collections().CreateScope(scopeName, nil)
+		if err != nil && !errors.Is(err, gocb.ErrScopeExists) {
+			return fmt.Errorf("failed to create scope %q: %w", scopeName, err)
+		}
+	}
+	for _, cs := range sources {
+		if cs.Collection == "_default" {
+			continue
+		}
+		err := bucket.Collections().CreateCollection(gocb.CollectionSpec{
+			Name:      cs.Collection,
+			ScopeName: scopeName,
+		}, nil)
+		if errors.Is(err, gocb.ErrCollectionExists) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create collection %q: %w", cs.Collection, err)
+		}
+	}
+	return nil
+}
+
+type loadDoc struct {
+	key string
+	doc map[string]any
+}
+
+// upsertAll streams the documents from the source to opts.Concurrency workers, stopping at the first error on either
+// side.
+func upsertAll(ctx context.Context, coll *gocb.Collection, cs data.CollectionSource, opts LoadOptions) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	concurrency := opts.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	docs := make(chan loadDoc, concurrency)
+	var loaded int64
+	var errOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range docs {
+				_, err := coll.Upsert(d.key, d.doc, &gocb.UpsertOptions{Context: ctx})
+				if err != nil {
+					fail(fmt.Errorf("failed to upsert %q: %w", d.key, err))
+					return
+				}
+				atomic.AddInt64(&loaded, 1)
+			}
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(loadProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				log.Printf("... %d documents so far", atomic.LoadInt64(&loaded))
+			}
+		}
+	}()
+
+	readErr := cs.ReadDocuments(opts.BaseDir, func(key string, doc map[string]any) error {
+		select {
+		case docs <- loadDoc{key, doc}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(docs)
+	wg.Wait()
+	if firstErr != nil {
+		return loaded, firstErr
+	}
+	return loaded, readErr
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+// QueryMetrics are the execution metrics of a player's query, as reported by the query service.
+type QueryMetrics struct {
+	ElapsedTime      time.Duration  `json:"elapsed_time"`
+	ExecutionTime    time.Duration  `json:"execution_time"`
+	ResultCount      uint64         `json:"result_count"`
+	ResultSize       uint64         `json:"result_size"`
+	SortCount        uint64         `json:"sort_count"`
+	DocumentsFetched uint64         `json:"documents_fetched"`
+	PrimaryScan      bool           `json:"primary_scan"`
+	Warnings         []QueryWarning `json:"warnings,omitempty"`
+}
+
+// QueryWarning is a warning from the query service, such as one about a deprecated function.
+type QueryWarning struct {
+	Code    uint32 `json:"code"`
+	Message string `json:"message"`
+}
+
+// metricsFromMeta extracts the metrics from a query's metadata. DocumentsFetched and PrimaryScan are only available
+// if the query was run with a profile.
+func metricsFromMeta(meta *gocb.QueryMetaData) *QueryMetrics {
+	result := &QueryMetrics{
+		ElapsedTime:   meta.Metrics.ElapsedTime,
+		ExecutionTime: meta.Metrics.ExecutionTime,
+		ResultCount:   meta.Metrics.ResultCount,
+		ResultSize:    meta.Metrics.ResultSize,
+		SortCount:     meta.Metrics.SortCount,
+	}
+	for _, w := range meta.Warnings {
+		result.Warnings = append(result.Warnings, QueryWarning{Code: w.Code, Message: w.Message})
+	}
+	profile, ok := meta.Profile.(map[string]any)
+	if !ok {
+		return result
+	}
+	phaseCounts, ok := profile["phaseCounts"].(map[string]any)
+	if !ok {
+		return result
+	}
+	for phase, count := range phaseCounts {
+		n, _ := count.(float64)
+		switch {
+		case phase == "fetch":
+			result.DocumentsFetched = uint64(n)
+		case strings.HasPrefix(phase, "primaryScan"):
+			result.PrimaryScan = true
+		}
+	}
+	return result
+}
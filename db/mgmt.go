@@ -12,6 +12,8 @@ type ManagementConnection struct {
 	cluster *gocb.Cluster
 	s       *gocb.Scope
 	bucket  *gocb.Bucket
+	// sandboxBucket is where the teams' sandboxes are created, away from the datasets.
+	sandboxBucket string
 }
 
 func (m *ManagementConnection) Close() error {
@@ -23,18 +25,23 @@ const (
 	cTeams               string = "teams"
 	cCompletedChallenges string = "completedChallenges"
 	cUsedHints           string = "usedHints"
+	cTeamIndexes         string = "teamIndexes"
+	cSandboxes           string = "sandboxes"
 )
 
 var mgmtCollections = [...]string{
 	cTeams,
 	cCompletedChallenges,
 	cUsedHints,
+	cTeamIndexes,
+	cSandboxes,
 }
 
 var mgmtIndexes = [...]string{
 	fmt.Sprintf("CREATE PRIMARY INDEX ON %s", cTeams),
 	fmt.Sprintf("CREATE INDEX idx_team_members ON `%s` (ALL members)", cTeams),
 	fmt.Sprintf(`CREATE INDEX idx_completedChallenges ON %s (team_id, dataset_id, query_id)`, cCompletedChallenges),
+	fmt.Sprintf(`CREATE INDEX idx_teamIndexes ON %s (team_id, dataset_id)`, cTeamIndexes),
 }
 
 func (m *ManagementConnection) init() error {
@@ -52,9 +59,30 @@ func (m *ManagementConnection) init() error {
 		}
 	}
 	log.Println("Creating indexes")
-	indexesNeedBuilding := 0
-	for _, idx := range mgmtIndexes {
-		_, err := m.s.Query(idx+" WITH {\"defer_build\": true}", nil)
+	stmts := make([]string, len(mgmtIndexes))
+	for i, idx := range mgmtIndexes {
+		stmts[i] = idx + " WITH {\"defer_build\": true}"
+	}
+	indexesNeedBuilding, err := createDeferredIndexes(m.s, stmts)
+	if err != nil {
+		return err
+	}
+	if indexesNeedBuilding > 0 {
+		log.Printf("Building %d indexes", indexesNeedBuilding)
+		err = buildDeferredIndexes(m.cluster, m.bucket.Name(), m.s.Name(), mgmtCollections[:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDeferredIndexes runs each of the CREATE INDEX statements (which should use defer_build) in the scope, skipping
+// any indexes that already exist, and returns how many it created.
+func createDeferredIndexes(s *gocb.Scope, stmts []string) (int, error) {
+	created := 0
+	for _, stmt := range stmts {
+		_, err := s.Query(stmt, nil)
 		if errors.Is(err, gocb.ErrIndexExists) {
 			continue
 		}
@@ -64,20 +92,22 @@ func (m *ManagementConnection) init() error {
 			continue
 		}
 		if err != nil {
-			return fmt.Errorf("failed to create index: %w", err)
+			return created, fmt.Errorf("failed to create index: %w", err)
 		}
-		indexesNeedBuilding++
+		created++
 	}
-	if indexesNeedBuilding > 0 {
-		log.Printf("Building %d indexes", indexesNeedBuilding)
-		for _, coll := range mgmtCollections {
-			_, err := m.cluster.QueryIndexes().BuildDeferredIndexes(m.bucket.Name(), &gocb.BuildDeferredQueryIndexOptions{
-				ScopeName:      m.s.Name(),
-				CollectionName: coll,
-			})
-			if err != nil {
-				return fmt.Errorf("failed to build deferred indexes on %s: %w", coll, err)
-			}
+	return created, nil
+}
+
+// buildDeferredIndexes builds all the deferred indexes on the collections at once.
+func buildDeferredIndexes(cluster *gocb.Cluster, bucket, scope string, collections []string) error {
+	for _, coll := range collections {
+		_, err := cluster.QueryIndexes().BuildDeferredIndexes(bucket, &gocb.BuildDeferredQueryIndexOptions{
+			ScopeName:      scope,
+			CollectionName: coll,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to build deferred indexes on %s: %w", coll, err)
 		}
 	}
 	return nil
@@ -2,125 +2,457 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
-	"reflect"
 	"strings"
 	"time"
 
+	"query-adventure/data"
+
 	"github.com/couchbase/gocb/v2"
-	"github.com/labstack/echo/v4"
+	"go.uber.org/multierr"
 )
 
 type QueryConnection struct {
-	cluster      *gocb.Cluster
-	queryTimeout time.Duration
+	cluster *gocb.Cluster
+	// sandboxCluster is connected as the sandbox user, which can only reach the sandbox bucket. Anything that might
+	// modify data runs on it.
+	sandboxCluster *gocb.Cluster
+	queryTimeout   time.Duration
 }
 
 func (c *QueryConnection) ExecuteQuery(ctx context.Context, keyspace, query string) ([]any, error) {
-	bucket, scope, ok := strings.Cut(keyspace, ".")
-	if !ok {
-		return nil, fmt.Errorf("invalid keyspace %q", keyspace)
+	ks, err := c.scope(keyspace)
+	if err != nil {
+		return nil, err
 	}
-	qr, err := c.cluster.Bucket(bucket).Scope(scope).Query(query, &gocb.QueryOptions{
+	qr, err := ks.Query(query, &gocb.QueryOptions{
 		Context: ctx,
 		Adhoc:   true,
 		Timeout: c.queryTimeout,
+		// Players' statements are checked before they get here, but this is what actually stops them changing the
+		// shared datasets.
+		Readonly: true,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("query error: %w", err)
 	}
-	var rows []any
+	return readAllRows(qr)
+}
+
+// ResultLimits caps how much of a query's result StreamQuery reads. Zero means no limit.
+type ResultLimits struct {
+	MaxRows  int
+	MaxBytes int
+}
+
+// StreamQuery runs a player's query, passing its rows to fn as they arrive rather than holding them all in memory. It
+// stops once the limits are reached, cancelling the query, in which case truncated is true. The query is read-only
+// unless sandbox is set, as for ExecuteQuery and ExecuteSandboxQuery, in which case keyspace must be a sandbox.
+//
+// The query service only sends the query's metrics once it's read to the end, so a truncated query's metrics are only
+// what was seen of it: how long it ran for before being cancelled, and the rows and bytes that were passed to fn.
+func (c *QueryConnection) StreamQuery(ctx context.Context, keyspace, query string, sandbox bool, limits ResultLimits, fn func(row json.RawMessage) error) (truncated bool, metrics *QueryMetrics, err error) {
+	scope := c.scope
+	if sandbox {
+		scope = c.sandboxScope
+	}
+	ks, err := scope(keyspace)
+	if err != nil {
+		return false, nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+	qr, err := ks.Query(query, &gocb.QueryOptions{
+		Context:  ctx,
+		Adhoc:    true,
+		Timeout:  c.queryTimeout,
+		Readonly: !sandbox,
+		Metrics:  true,
+	})
+	if err != nil {
+		return false, nil, newQueryFailure(err)
+	}
+	var rows, size int
 	for qr.Next() {
-		var row any
-		err = qr.Row(&row)
-		if err != nil {
-			return nil, fmt.Errorf("row error: %w", err)
+		var row json.RawMessage
+		if err = qr.Row(&row); err != nil {
+			_ = qr.Close()
+			return false, nil, fmt.Errorf("row error: %w", err)
+		}
+		if (limits.MaxRows > 0 && rows >= limits.MaxRows) || (limits.MaxBytes > 0 && size+len(row) > limits.MaxBytes) {
+			// There's more than we're allowed to send, so there's no point letting the query carry on.
+			cancel()
+			_ = qr.Close()
+			return true, &QueryMetrics{
+				ElapsedTime: time.Since(start),
+				ResultCount: uint64(rows),
+				ResultSize:  uint64(size),
+			}, nil
+		}
+		rows++
+		size += len(row)
+		if err = fn(row); err != nil {
+			_ = qr.Close()
+			return false, nil, err
 		}
-		rows = append(rows, row)
+	}
+	if meta, err := qr.MetaData(); err == nil {
+		metrics = metricsFromMeta(meta)
 	}
 	err = qr.Close()
 	if err != nil {
-		return nil, fmt.Errorf("close error: %w", err)
+		// Errors that happen part way through the query only turn up here.
+		return false, metrics, newQueryFailure(err)
+	}
+	return false, metrics, nil
+}
+
+// ExecuteSandboxQuery is like ExecuteQuery, but for a team's sandbox (see ManagementConnection.Sandbox), so the
+// statement is allowed to modify data.
+func (c *QueryConnection) ExecuteSandboxQuery(ctx context.Context, keyspace, query string, params data.Params) ([]any, error) {
+	ks, err := c.sandboxScope(keyspace)
+	if err != nil {
+		return nil, err
 	}
-	return rows, nil
+	qr, err := ks.Query(query, &gocb.QueryOptions{
+		Context:         ctx,
+		Adhoc:           true,
+		Timeout:         c.queryTimeout,
+		NamedParameters: params,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+	return readAllRows(qr)
 }
 
-func (c *QueryConnection) ExecuteAndVerifyQuery(ctx context.Context, keyspace, target, input string) error {
+// FirstRow runs the query and returns just its first row, cancelling it once that's been read. hasRow is false if the
+// query returned no rows.
+func (c *QueryConnection) FirstRow(ctx context.Context, keyspace, query string, params data.Params) (row any, hasRow bool, err error) {
+	ks, err := c.scope(keyspace)
+	if err != nil {
+		return nil, false, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	qr, err := ks.Query(query, &gocb.QueryOptions{
+		Context:         ctx,
+		Adhoc:           true,
+		Timeout:         c.queryTimeout,
+		NamedParameters: params,
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("query error: %w", err)
+	}
+	if !qr.Next() {
+		return nil, false, qr.Close()
+	}
+	err = qr.Row(&row)
+	if err != nil {
+		_ = qr.Close()
+		return nil, false, fmt.Errorf("row error: %w", err)
+	}
+	cancel()
+	_ = qr.Close()
+	return row, true, nil
+}
+
+func (c *QueryConnection) scope(keyspace string) (*gocb.Scope, error) {
+	return scopeOf(c.cluster, keyspace)
+}
+
+// sandboxScope is like scope, but connected as the sandbox user.
+func (c *QueryConnection) sandboxScope(keyspace string) (*gocb.Scope, error) {
+	return scopeOf(c.sandboxCluster, keyspace)
+}
+
+func scopeOf(cluster *gocb.Cluster, keyspace string) (*gocb.Scope, error) {
 	bucket, scope, ok := strings.Cut(keyspace, ".")
 	if !ok {
-		return fmt.Errorf("invalid keyspace %q", keyspace)
+		return nil, fmt.Errorf("invalid keyspace %q", keyspace)
 	}
-	ks := c.cluster.Bucket(bucket).Scope(scope)
-	targetQR, err := ks.Query(target, &gocb.QueryOptions{
-		Context: ctx,
-		Adhoc:   true,
-		Timeout: c.queryTimeout,
-	})
+	return cluster.Bucket(bucket).Scope(scope), nil
+}
+
+// targetOpener starts streaming the expected rows for one of a challenge's reference results.
+type targetOpener func(ctx context.Context) (rowSource, error)
+
+// ExecuteAndVerifyQuery runs the input query and checks that its results match those of one of the query's reference
+// queries, according to its verify settings. If none of them match, the error describes the mismatch against the
+// closest one. Any params are passed as named parameters to all the queries.
+//
+// If the input query was read to the end, its metrics are returned as well, even if it didn't match.
+func (c *QueryConnection) ExecuteAndVerifyQuery(ctx context.Context, keyspace string, query data.Query, input string, params data.Params) (*QueryMetrics, error) {
+	ks, err := c.scope(keyspace)
+	if err != nil {
+		return nil, err
+	}
+	targets := query.ReferenceQueries()
+	openers := make([]targetOpener, len(targets))
+	for i, target := range targets {
+		target := target
+		openers[i] = func(ctx context.Context) (rowSource, error) {
+			targetQR, err := ks.Query(target, &gocb.QueryOptions{
+				Context:         ctx,
+				Adhoc:           true,
+				Timeout:         c.queryTimeout,
+				NamedParameters: params,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("query 1 error: %w", err)
+			}
+			return targetQR, nil
+		}
+	}
+	return c.verifyInput(ctx, ks, query, openers, input, params)
+}
+
+// ExecuteAndVerifyQueryAgainstSnapshot is like ExecuteAndVerifyQuery, but streams the expected rows from the query's
+// stored snapshots rather than running its reference queries again.
+func (c *QueryConnection) ExecuteAndVerifyQueryAgainstSnapshot(ctx context.Context, snaps *Snapshots, ds data.Dataset, query data.Query, input string) (*QueryMetrics, error) {
+	ks, err := c.scope(ds.Keyspace)
+	if err != nil {
+		return nil, err
+	}
+	openers := make([]targetOpener, len(query.ReferenceQueries()))
+	for i := range openers {
+		i := i
+		openers[i] = func(context.Context) (rowSource, error) {
+			return snaps.open(ds.ID, query, i)
+		}
+	}
+	return c.verifyInput(ctx, ks, query, openers, input, nil)
+}
+
+// errRollback is returned from a transaction to roll it back, once it's done what it needs to.
+var errRollback = errors.New("rollback")
+
+// ExecuteAndVerifyInTransaction checks a submission to a data-modifying challenge (see data.Query.VerifiesInTransaction).
+// The input runs in a transaction followed by the challenge's verification SELECT, and so does the reference query,
+// then the SELECTs' results are compared. Both transactions are rolled back, so the sandbox is never changed.
+//
+// keyspace must be the team's transaction sandbox (see ManagementConnection.TransactionSandbox), as the transactions
+// run as the sandbox user, which can't get at the datasets themselves.
+//
+// The two transactions run one after the other, as they'd most likely be modifying the same documents.
+func (c *QueryConnection) ExecuteAndVerifyInTransaction(ctx context.Context, keyspace string, query data.Query, input string, params data.Params) error {
+	ks, err := c.sandboxScope(keyspace)
+	if err != nil {
+		return err
+	}
+	targetRows, err := c.selectAfter(ctx, ks, query.Query, query.Verify.Select, params)
 	if err != nil {
 		return fmt.Errorf("query 1 error: %w", err)
 	}
-	inputQR, err := ks.Query(input, &gocb.QueryOptions{
-		Context: ctx,
-		Adhoc:   true,
+	inputRows, err := c.selectAfter(ctx, ks, input, query.Verify.Select, params)
+	if err != nil {
+		return newQueryFailure(err)
+	}
+	_, err = verifyRows(query.Verify, newSliceRows(targetRows), newSliceRows(inputRows))
+	return err
+}
+
+// selectAfter runs the statement and then the SELECT in a transaction, returning the SELECT's rows, and then rolls
+// the transaction back.
+func (c *QueryConnection) selectAfter(ctx context.Context, ks *gocb.Scope, stmt, check string, params data.Params) ([]any, error) {
+	var rows []any
+	_, err := c.sandboxCluster.Transactions().Run(func(tx *gocb.TransactionAttemptContext) error {
+		opts := &gocb.TransactionQueryOptions{
+			Scope:           ks,
+			NamedParameters: params,
+		}
+		_, err := tx.Query(stmt, opts)
+		if err != nil {
+			return err
+		}
+		qr, err := tx.Query(check, opts)
+		if err != nil {
+			return fmt.Errorf("verify select failed: %w", err)
+		}
+		// The lambda can be retried, so start again each time.
+		rows = nil
+		for qr.Next() {
+			var row any
+			if err = qr.Row(&row); err != nil {
+				return fmt.Errorf("row error: %w", err)
+			}
+			rows = append(rows, row)
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		return errRollback
+	}, &gocb.TransactionOptions{
 		Timeout: c.queryTimeout,
 	})
-	if errors.Is(err, gocb.ErrAmbiguousTimeout) {
-		return echo.NewHTTPError(http.StatusBadRequest, "Your query timed out.")
+	if errors.Is(err, errRollback) {
+		return rows, nil
 	}
-	if err != nil {
-		return fmt.Errorf("query 2 error: %w", err)
+	if err == nil {
+		// Should be impossible, as the lambda never returns nil.
+		return nil, fmt.Errorf("transaction committed instead of rolling back")
+	}
+	return nil, err
+}
+
+type openResult struct {
+	rs  rowSource
+	err error
+}
+
+// verifyInput starts the input query and all the targets in parallel, and compares the rows as they stream in from
+// both sides. Each side runs with its own context, which is cancelled when it's closed, so the first mismatch stops
+// all the queries rather than waiting for them to finish.
+//
+// Performance challenges are the exception: the input's elapsed time is part of its score, so it runs to the end on its
+// own before the targets start, rather than competing with them.
+func (c *QueryConnection) verifyInput(ctx context.Context, ks *gocb.Scope, query data.Query, targets []targetOpener, input string, params data.Params) (*QueryMetrics, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no target queries")
 	}
+	verify := query.Verify
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	var targetRows, inputRows uint
-	var finalErr error
-	var targetRow, inputRow any
-	for targetQR.Next() {
-		targetRows++
-		err = targetQR.Row(&targetRow)
+	inputOpts := &gocb.QueryOptions{
+		Adhoc:           true,
+		Timeout:         c.queryTimeout,
+		NamedParameters: params,
+		Metrics:         true,
+		Readonly:        true,
+	}
+	if query.Performance != nil {
+		// Needed for the number of documents fetched and whether there was a primary scan.
+		inputOpts.Profile = gocb.QueryProfileModePhases
+		inputOpts.Context = ctx
+		inputQR, err := ks.Query(input, inputOpts)
 		if err != nil {
-			return fmt.Errorf("failed to parse row from target: %w", err)
+			return nil, newQueryFailure(err)
 		}
-
-		ok := inputQR.Next()
-		if !ok {
-			goto notEnough
+		inputRows, err := readAllRows(inputQR)
+		if err != nil {
+			return nil, newQueryFailure(err)
+		}
+		var metrics *QueryMetrics
+		if meta, err := inputQR.MetaData(); err == nil {
+			metrics = metricsFromMeta(meta)
 		}
-		inputRows++
-		err = inputQR.Row(&inputRow)
+		targetQRs, err := openTargets(startTargets(ctx, targets))
 		if err != nil {
-			return fmt.Errorf("failed to parse row from input: %w", err)
+			for _, rs := range targetQRs {
+				_ = rs.Close()
+			}
+			return nil, err
 		}
+		return metrics, verifyClosest(verify, targetQRs, inputRows)
+	}
 
-		if !reflect.DeepEqual(targetRow, inputRow) {
-			finalErr = errMismatch(inputRows, targetRow, inputRow)
-			goto exit
+	targetResults := startTargets(ctx, targets)
+	ictx, icancel := context.WithCancel(ctx)
+	defer icancel()
+	inputOpts.Context = ictx
+	inputQR, inputErr := ks.Query(input, inputOpts)
+	targetQRs, targetErr := openTargets(targetResults)
+	if inputErr != nil || targetErr != nil {
+		for _, rs := range targetQRs {
+			_ = rs.Close()
+		}
+		if inputErr == nil {
+			icancel()
+			_ = inputQR.Close()
+			return nil, targetErr
 		}
+		return nil, newQueryFailure(inputErr)
 	}
-	if inputQR.Next() {
-		inputRows++
-		err = inputQR.Row(&inputRow)
-		if err != nil {
-			return fmt.Errorf("failed to parse row from input (in too many rows loop): %w", err)
-		}
-		for inputQR.Next() {
-			inputRows++
-		}
-		finalErr = errTooManyRows(targetRows, inputRows, targetRow, inputRow)
-		goto exit
-	}
-	finalErr = nil
-	goto exit
-notEnough:
-	// Run target to the end to get the expected number
-	for targetQR.Next() {
-		targetRows++
-	}
-	finalErr = errNotEnoughRows(targetRows, inputRows, inputRow, targetRow)
-	goto exit
-exit:
-	err = targetQR.Close()
-	err = inputQR.Close()
-	return finalErr
+	inputRS := prefetchRows(inputQR, icancel)
+	inputMetrics := func() *QueryMetrics {
+		if inputRS.meta == nil {
+			return nil
+		}
+		return metricsFromMeta(inputRS.meta)
+	}
+
+	if len(targetQRs) == 1 {
+		// Only one target, so we can stream both sides without holding them in memory.
+		_, err := verifyRows(verify, targetQRs[0], inputRS)
+		return inputMetrics(), err
+	}
+
+	// With several targets we need to compare the input against each in turn, so buffer it.
+	inputRows, err := readAllRows(inputRS)
+	if err != nil {
+		for _, rs := range targetQRs {
+			_ = rs.Close()
+		}
+		return nil, newQueryFailure(err)
+	}
+	return inputMetrics(), verifyClosest(verify, targetQRs, inputRows)
+}
+
+// startTargets starts all the targets in parallel, each with its own context, returning a channel for each that gets
+// its rows (or the error) once it's started.
+func startTargets(ctx context.Context, targets []targetOpener) []chan openResult {
+	results := make([]chan openResult, len(targets))
+	for i, target := range targets {
+		results[i] = make(chan openResult, 1)
+		go func(target targetOpener, result chan<- openResult) {
+			tctx, tcancel := context.WithCancel(ctx)
+			rs, err := target(tctx)
+			if err != nil {
+				tcancel()
+				result <- openResult{err: err}
+				return
+			}
+			result <- openResult{rs: prefetchRows(rs, tcancel)}
+		}(target, results[i])
+	}
+	return results
+}
+
+// openTargets waits for the targets started by startTargets. If any of them failed, the rest are still returned, so
+// the caller can close them.
+func openTargets(results []chan openResult) ([]rowSource, error) {
+	targetQRs := make([]rowSource, 0, len(results))
+	var errs error
+	for _, result := range results {
+		res := <-result
+		if res.err != nil {
+			errs = multierr.Append(errs, res.err)
+			continue
+		}
+		targetQRs = append(targetQRs, res.rs)
+	}
+	return targetQRs, errs
+}
+
+// verifyClosest checks the input rows against each target in turn, closing them all, and passes if any of them match.
+// Otherwise, the mismatch is reported against the target that matched the most rows before its first difference (or
+// the first of those, if there's a tie). Errors other than mismatches are returned straight away.
+func verifyClosest(verify data.Verify, targets []rowSource, inputRows []any) error {
+	var closestErr error
+	var closestMatched uint
+	for i, target := range targets {
+		matched, err := verifyRows(verify, target, newSliceRows(inputRows))
+		if err == nil {
+			for _, rs := range targets[i+1:] {
+				_ = rs.Close()
+			}
+			return nil
+		}
+		var verifyErr *VerifyError
+		if !errors.As(err, &verifyErr) {
+			for _, rs := range targets[i+1:] {
+				_ = rs.Close()
+			}
+			return err
+		}
+		if closestErr == nil || matched > closestMatched {
+			closestErr = err
+			closestMatched = matched
+		}
+	}
+	return closestErr
 }
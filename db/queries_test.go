@@ -0,0 +1,108 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"query-adventure/data"
+)
+
+// fakeRows is a rowSource over rows in memory that records whether it's been closed, and can fail when it is, as a
+// query result does when the query fails part way through.
+type fakeRows struct {
+	*sliceRows
+	closeErr error
+	closed   bool
+}
+
+func newFakeRows(rows []any, closeErr error) *fakeRows {
+	return &fakeRows{sliceRows: newSliceRows(rows), closeErr: closeErr}
+}
+
+func (f *fakeRows) Close() error {
+	f.closed = true
+	return f.closeErr
+}
+
+func TestVerifyClosest(t *testing.T) {
+	errTargetFailed := errors.New("target failed")
+	tests := []struct {
+		name    string
+		verify  data.Verify
+		targets []string
+		// failing is the index of a target whose query fails, or -1.
+		failing int
+		input   string
+		ok      bool
+		wantMsg verifyMessage
+		wantErr error
+	}{
+		{name: "first matches", targets: []string{`[1,2]`, `[3,4]`}, failing: -1, input: `[1,2]`, ok: true},
+		{name: "second matches", targets: []string{`[1,2]`, `[3,4]`}, failing: -1, input: `[3,4]`, ok: true},
+		{name: "last matches", targets: []string{`[1]`, `[2]`, `[3]`}, failing: -1, input: `[3]`, ok: true},
+		{
+			name:    "closest is the one that matched most rows",
+			targets: []string{`[1,9]`, `[1,2,3,4]`, `[5]`},
+			failing: -1,
+			input:   `[1,2,3]`,
+			wantMsg: msgNotEnoughRows,
+		},
+		{
+			name:    "ties go to the first",
+			targets: []string{`[1,9]`, `[1]`},
+			failing: -1,
+			input:   `[1,2]`,
+			wantMsg: msgMismatch,
+		},
+		{
+			name:    "closest with any order",
+			verify:  data.Verify{Order: data.OrderAny},
+			targets: []string{`[{"a":1},{"a":2}]`, `[{"a":5},{"a":4},{"a":2},{"a":1}]`},
+			failing: -1,
+			input:   `[{"a":2},{"a":1},{"a":4}]`,
+			wantMsg: msgMissingRow,
+		},
+		{
+			// The failing target's rows so far match, so it's only found to have failed when it's closed.
+			name:    "target failure isn't a mismatch",
+			targets: []string{`[1]`, `[3]`, `[3]`},
+			failing: 1,
+			input:   `[3]`,
+			wantErr: errTargetFailed,
+		},
+		{
+			name:    "failure after a match doesn't matter",
+			targets: []string{`[1]`, `[2]`},
+			failing: 1,
+			input:   `[1]`,
+			ok:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := make([]rowSource, len(tt.targets))
+			fakes := make([]*fakeRows, len(tt.targets))
+			for i, rows := range tt.targets {
+				var closeErr error
+				if i == tt.failing {
+					closeErr = errTargetFailed
+				}
+				fakes[i] = newFakeRows(jsonRows(t, rows), closeErr)
+				targets[i] = fakes[i]
+			}
+			err := verifyClosest(tt.verify, targets, jsonRows(t, tt.input))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("got error %v, want %v", err, tt.wantErr)
+				}
+			} else {
+				checkVerifyResult(t, err, tt.ok, tt.wantMsg)
+			}
+			for i, f := range fakes {
+				if !f.closed {
+					t.Errorf("target %d wasn't closed", i)
+				}
+			}
+		})
+	}
+}
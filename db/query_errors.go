@@ -1,11 +1,15 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
 
-	"github.com/labstack/echo/v4"
+	"github.com/couchbase/gocb/v2"
 )
 
 func mustMarshalJSON(row any) []byte {
@@ -13,20 +17,164 @@ func mustMarshalJSON(row any) []byte {
 	return jv
 }
 
+// DefaultVerifyLocale is the locale VerifyError messages fall back to when there's no translation.
+const DefaultVerifyLocale = "en"
+
+type verifyMessage int
+
+const (
+	msgNotEnoughRows verifyMessage = iota
+	msgTooManyRows
+	msgMismatch
+	msgMissingRow
+	msgUnexpectedRow
+)
+
+// verifyMessages holds the format strings for each VerifyError, keyed by locale. Every locale must have the same
+// verbs in the same order as the English.
+var verifyMessages = map[string]map[verifyMessage]string{
+	"en": {
+		msgNotEnoughRows: "Your query did not return as many rows as it should have done (we expected %d, but only got %d). The last row your query returned was %s, and the next we expected would have been %s.",
+		msgTooManyRows:   "Your query returned too many rows (we expected %d, but got %d). The last row we expected was %s, and the next one your query returned was %s.",
+		msgMismatch:      "Your query gave an unexpected result on row %d: we were expecting to see %s, but saw %s",
+		msgMissingRow:    "Your query is missing a row (we expected %d rows in any order, and got %d): we were expecting to see %s somewhere, but didn't.",
+		msgUnexpectedRow: "Your query returned a row we weren't expecting (we expected %d rows in any order, and got %d): %s should not be there.",
+	},
+	"de": {
+		msgNotEnoughRows: "Deine Abfrage hat nicht so viele Zeilen geliefert wie erwartet (wir haben %d erwartet, aber nur %d bekommen). Die letzte Zeile deiner Abfrage war %s, und als nächste hätten wir %s erwartet.",
+		msgTooManyRows:   "Deine Abfrage hat zu viele Zeilen geliefert (wir haben %d erwartet, aber %d bekommen). Die letzte erwartete Zeile war %s, und die nächste Zeile deiner Abfrage war %s.",
+		msgMismatch:      "Deine Abfrage hat in Zeile %d ein unerwartetes Ergebnis geliefert: wir haben %s erwartet, aber %s gesehen",
+		msgMissingRow:    "Deiner Abfrage fehlt eine Zeile (wir haben %d Zeilen in beliebiger Reihenfolge erwartet und %d bekommen): wir haben irgendwo %s erwartet, aber nicht gefunden.",
+		msgUnexpectedRow: "Deine Abfrage hat eine unerwartete Zeile geliefert (wir haben %d Zeilen in beliebiger Reihenfolge erwartet und %d bekommen): %s gehört nicht dazu.",
+	},
+}
+
+// VerifyLocales returns the locales that VerifyError messages have been translated into.
+func VerifyLocales() []string {
+	result := make([]string, 0, len(verifyMessages))
+	for locale := range verifyMessages {
+		result = append(result, locale)
+	}
+	return result
+}
+
+// VerifyError is returned when a submission's results don't match the expected ones. Error returns the message in
+// the default locale, and Localize translates it.
+type VerifyError struct {
+	msg  verifyMessage
+	args []any
+}
+
+func (e *VerifyError) Error() string {
+	return e.Localize(DefaultVerifyLocale)
+}
+
+// Localize returns the error message in the given locale, falling back to the default locale if there's no
+// translation.
+func (e *VerifyError) Localize(locale string) string {
+	format, ok := verifyMessages[locale][e.msg]
+	if !ok {
+		format = verifyMessages[DefaultVerifyLocale][e.msg]
+	}
+	return fmt.Sprintf(format, e.args...)
+}
+
 func errNotEnoughRows(expected, actual uint, lastSeen, nextWanted any) error {
-	return echo.NewHTTPError(http.StatusExpectationFailed, fmt.Sprintf(
-		"Your query did not return as many rows as it should have done (we expected %d, but only got %d). The last row your query returned was %s, and the next we expected would have been %s.",
-		expected, actual, mustMarshalJSON(lastSeen), mustMarshalJSON(nextWanted)))
+	return &VerifyError{msgNotEnoughRows, []any{expected, actual, mustMarshalJSON(lastSeen), mustMarshalJSON(nextWanted)}}
 }
 
 func errTooManyRows(expected uint, actual uint, lastWanted, nextSeen any) error {
-	return echo.NewHTTPError(http.StatusExpectationFailed, fmt.Sprintf(
-		"Your query returned too many rows (we expected %d, but got %d). The last row we expected was %s, and the next one your query returned was %s.",
-		expected, actual, mustMarshalJSON(lastWanted), mustMarshalJSON(nextSeen)))
+	return &VerifyError{msgTooManyRows, []any{expected, actual, mustMarshalJSON(lastWanted), mustMarshalJSON(nextSeen)}}
 }
 
 func errMismatch(row uint, expected, actual any) error {
-	return echo.NewHTTPError(http.StatusExpectationFailed, fmt.Sprintf(
-		"Your query gave an unexpected result on row %d: we were expecting to see %s, but saw %s",
-		row, mustMarshalJSON(expected), mustMarshalJSON(actual)))
+	return &VerifyError{msgMismatch, []any{row, mustMarshalJSON(expected), mustMarshalJSON(actual)}}
+}
+
+func errMissingRow(expected, actual uint, missing any) error {
+	return &VerifyError{msgMissingRow, []any{expected, actual, mustMarshalJSON(missing)}}
+}
+
+func errUnexpectedRow(expected, actual uint, unexpected any) error {
+	return &VerifyError{msgUnexpectedRow, []any{expected, actual, mustMarshalJSON(unexpected)}}
+}
+
+// QueryFailure is a player's statement failing to run, described in a way that's fit to show them rather than as the
+// query service's error.
+type QueryFailure struct {
+	// Status is the HTTP status to report the failure with - 4xx if it's down to the statement, or 5xx if it's a
+	// problem with the cluster.
+	Status int `json:"-"`
+	// Code is the query service's error code, if it got that far.
+	Code    uint32 `json:"code,omitempty"`
+	Message string `json:"message"`
+	// Line and Column are where in the statement the problem is, if the query service said.
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+	err    error
+}
+
+func (f *QueryFailure) Error() string {
+	return f.Message
+}
+
+func (f *QueryFailure) Unwrap() error {
+	return f.err
+}
+
+// queryErrorPositionRe finds the position in query service messages like "syntax error - line 1, column 8, near ...".
+var queryErrorPositionRe = regexp.MustCompile(`line (\d+), column (\d+)`)
+
+// newQueryFailure describes an error from running a player's statement. Errors from the query service are classified
+// by their code, according to the ranges the service uses: 3xxx are parse errors, 4xxx planning, 5xxx execution, 10xxx
+// authorization, and 12xxx/13xxx datastore errors.
+func newQueryFailure(err error) *QueryFailure {
+	if errors.Is(err, gocb.ErrTimeout) || errors.Is(err, gocb.ErrAttemptExpired) || errors.Is(err, context.DeadlineExceeded) {
+		return &QueryFailure{Status: http.StatusBadRequest, Message: "Your query timed out.", err: err}
+	}
+	var qe *gocb.QueryError
+	if !errors.As(err, &qe) || len(qe.Errors) == 0 {
+		return &QueryFailure{Status: http.StatusInternalServerError, Message: "Something went wrong running your query - please try again.", err: err}
+	}
+	desc := qe.Errors[0]
+	result := &QueryFailure{Code: desc.Code, err: err}
+	switch {
+	case desc.Code == 1080:
+		result.Status = http.StatusBadRequest
+		result.Message = "Your query timed out."
+		return result
+	case desc.Code >= 3000 && desc.Code < 4000:
+		result.Status = http.StatusBadRequest
+		result.Message = "Syntax error: " + strings.TrimPrefix(desc.Message, "syntax error - ")
+	case desc.Code >= 4000 && desc.Code < 5000:
+		result.Status = http.StatusBadRequest
+		result.Message = "Couldn't plan your query: " + desc.Message
+	case desc.Code >= 5000 && desc.Code < 6000:
+		result.Status = http.StatusBadRequest
+		result.Message = "Your query failed: " + desc.Message
+	case desc.Code >= 10000 && desc.Code < 11000:
+		result.Status = http.StatusForbidden
+		result.Message = "You're not allowed to query that: " + desc.Message
+	case errors.Is(err, gocb.ErrScopeNotFound) || errors.Is(err, gocb.ErrCollectionNotFound) || desc.Code == 12003 || desc.Code == 12021:
+		result.Status = http.StatusNotFound
+		result.Message = "No such keyspace: " + desc.Message
+	case desc.Retry:
+		result.Status = http.StatusServiceUnavailable
+		result.Message = fmt.Sprintf("The query service is busy (error %d) - please try again.", desc.Code)
+		return result
+	default:
+		// Anything else is a problem with the cluster, whose details players don't need to see.
+		result.Status = http.StatusInternalServerError
+		result.Message = fmt.Sprintf("The query service failed to run your query (error %d) - please try again.", desc.Code)
+		return result
+	}
+	line, lineOK := desc.Reason["line"].(float64)
+	column, columnOK := desc.Reason["column"].(float64)
+	if lineOK && columnOK {
+		result.Line, result.Column = int(line), int(column)
+	} else if m := queryErrorPositionRe.FindStringSubmatch(desc.Message); m != nil {
+		_, _ = fmt.Sscan(m[1], &result.Line)
+		_, _ = fmt.Sscan(m[2], &result.Column)
+	}
+	return result
 }
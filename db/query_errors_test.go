@@ -0,0 +1,190 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+func queryError(inner error, descs ...gocb.QueryErrorDesc) error {
+	return &gocb.QueryError{InnerError: inner, Statement: "SELECT ...", Errors: descs}
+}
+
+func TestNewQueryFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   uint32
+		wantMsg    string
+		wantLine   int
+		wantColumn int
+	}{
+		{
+			name:       "syntax error with position in the reason",
+			err:        queryError(gocb.ErrParsingFailure, gocb.QueryErrorDesc{Code: 3000, Message: "syntax error - at FORM", Reason: map[string]any{"line": 1.0, "column": 10.0}}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   3000,
+			wantMsg:    "Syntax error: at FORM",
+			wantLine:   1,
+			wantColumn: 10,
+		},
+		{
+			name:       "syntax error with position in the message",
+			err:        queryError(gocb.ErrParsingFailure, gocb.QueryErrorDesc{Code: 3000, Message: "syntax error - line 2, column 14, near 'FROM x', at: WERE"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   3000,
+			wantMsg:    "Syntax error: line 2, column 14, near 'FROM x', at: WERE",
+			wantLine:   2,
+			wantColumn: 14,
+		},
+		{
+			name:       "reason position wins over the message",
+			err:        queryError(nil, gocb.QueryErrorDesc{Code: 3000, Message: "syntax error - line 9, column 9", Reason: map[string]any{"line": 3.0, "column": 4.0}}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   3000,
+			wantMsg:    "Syntax error: line 9, column 9",
+			wantLine:   3,
+			wantColumn: 4,
+		},
+		{
+			name:       "only a line in the reason",
+			err:        queryError(nil, gocb.QueryErrorDesc{Code: 3000, Message: "syntax error", Reason: map[string]any{"line": 3.0}}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   3000,
+			wantMsg:    "Syntax error: syntax error",
+		},
+		{
+			name:       "semantic error",
+			err:        queryError(nil, gocb.QueryErrorDesc{Code: 3100, Message: "Duplicate variable x"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   3100,
+			wantMsg:    "Syntax error: Duplicate variable x",
+		},
+		{
+			name:       "planning error",
+			err:        queryError(gocb.ErrPlanningFailure, gocb.QueryErrorDesc{Code: 4000, Message: "No index available on keyspace hotel"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   4000,
+			wantMsg:    "Couldn't plan your query: No index available on keyspace hotel",
+		},
+		{
+			name:       "execution error",
+			err:        queryError(nil, gocb.QueryErrorDesc{Code: 5010, Message: "Error evaluating projection"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   5010,
+			wantMsg:    "Your query failed: Error evaluating projection",
+		},
+		{
+			name:       "authorization error",
+			err:        queryError(gocb.ErrAuthenticationFailure, gocb.QueryErrorDesc{Code: 13014, Message: "User does not have credentials"}),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   13014,
+			wantMsg:    "The query service failed to run your query (error 13014) - please try again.",
+		},
+		{
+			name:       "privilege error",
+			err:        queryError(nil, gocb.QueryErrorDesc{Code: 10104, Message: "Incorrect credentials"}),
+			wantStatus: http.StatusForbidden,
+			wantCode:   10104,
+			wantMsg:    "You're not allowed to query that: Incorrect credentials",
+		},
+		{
+			name:       "missing keyspace",
+			err:        queryError(gocb.ErrIndexFailure, gocb.QueryErrorDesc{Code: 12003, Message: "Keyspace not found in CB datastore: default:nope"}),
+			wantStatus: http.StatusNotFound,
+			wantCode:   12003,
+			wantMsg:    "No such keyspace: Keyspace not found in CB datastore: default:nope",
+		},
+		{
+			name:       "missing collection",
+			err:        queryError(gocb.ErrCollectionNotFound, gocb.QueryErrorDesc{Code: 12021, Message: "Scope not found in CB datastore"}),
+			wantStatus: http.StatusNotFound,
+			wantCode:   12021,
+			wantMsg:    "No such keyspace: Scope not found in CB datastore",
+		},
+		{
+			name:       "server timeout",
+			err:        queryError(nil, gocb.QueryErrorDesc{Code: 1080, Message: "Timeout 1m0s exceeded"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   1080,
+			wantMsg:    "Your query timed out.",
+		},
+		{
+			name:       "retryable",
+			err:        queryError(nil, gocb.QueryErrorDesc{Code: 12009, Message: "DML Error", Retry: true}),
+			wantStatus: http.StatusServiceUnavailable,
+			wantCode:   12009,
+			wantMsg:    "The query service is busy (error 12009) - please try again.",
+		},
+		{
+			name:       "server fault",
+			err:        queryError(gocb.ErrInternalServerFailure, gocb.QueryErrorDesc{Code: 12008, Message: "Error performing bulk get operation", Reason: map[string]any{"line": 1.0, "column": 1.0}}),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   12008,
+			wantMsg:    "The query service failed to run your query (error 12008) - please try again.",
+		},
+		{
+			name:       "only the first error counts",
+			err:        queryError(nil, gocb.QueryErrorDesc{Code: 4000, Message: "first"}, gocb.QueryErrorDesc{Code: 12008, Message: "second"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   4000,
+			wantMsg:    "Couldn't plan your query: first",
+		},
+		{
+			name:       "wrapped",
+			err:        fmt.Errorf("row error: %w", queryError(nil, gocb.QueryErrorDesc{Code: 5000, Message: "oops"})),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   5000,
+			wantMsg:    "Your query failed: oops",
+		},
+		{
+			name:       "client timeout",
+			err:        fmt.Errorf("query: %w", gocb.ErrUnambiguousTimeout),
+			wantStatus: http.StatusBadRequest,
+			wantMsg:    "Your query timed out.",
+		},
+		{
+			name:       "context deadline",
+			err:        context.DeadlineExceeded,
+			wantStatus: http.StatusBadRequest,
+			wantMsg:    "Your query timed out.",
+		},
+		{
+			name:       "query error without details",
+			err:        queryError(gocb.ErrServiceNotAvailable),
+			wantStatus: http.StatusInternalServerError,
+			wantMsg:    "Something went wrong running your query - please try again.",
+		},
+		{
+			name:       "not a query error",
+			err:        errors.New("connection reset"),
+			wantStatus: http.StatusInternalServerError,
+			wantMsg:    "Something went wrong running your query - please try again.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newQueryFailure(tt.err)
+			if got.Status != tt.wantStatus {
+				t.Errorf("status %d, want %d", got.Status, tt.wantStatus)
+			}
+			if got.Code != tt.wantCode {
+				t.Errorf("code %d, want %d", got.Code, tt.wantCode)
+			}
+			if got.Message != tt.wantMsg {
+				t.Errorf("message %q, want %q", got.Message, tt.wantMsg)
+			}
+			if got.Line != tt.wantLine || got.Column != tt.wantColumn {
+				t.Errorf("position %d:%d, want %d:%d", got.Line, got.Column, tt.wantLine, tt.wantColumn)
+			}
+			if !errors.Is(got, tt.err) {
+				t.Errorf("failure doesn't wrap the original error")
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"query-adventure/data"
+
+	"github.com/couchbase/gocb/v2"
+	"golang.org/x/exp/slices"
+)
+
+// ErrSandboxNotReady is returned when another request is still creating the team's sandbox.
+var ErrSandboxNotReady = errors.New("sandbox is still being created")
+
+const (
+	// sandboxCreateTimeout is how long a sandbox can be in the middle of being created before we assume whoever was
+	// creating it has died, and take over.
+	sandboxCreateTimeout = 10 * time.Minute
+	sandboxIndexTimeout  = 2 * time.Minute
+	sandboxCopyTimeout   = 5 * time.Minute
+)
+
+// sandboxKind distinguishes the sandboxes that a team has for each dataset that has them (see data.Dataset.HasSandboxes).
+type sandboxKind string
+
+const (
+	// sandboxPlay is the one the team's queries run in, which keeps their changes until they reset it.
+	sandboxPlay sandboxKind = "sbx"
+	// sandboxCheck and sandboxRef are reset for every submission, and the submission and reference query run in them
+	// respectively.
+	sandboxCheck sandboxKind = "chk"
+	sandboxRef   sandboxKind = "ref"
+	// sandboxTxn is where submissions to data-modifying challenges on other datasets run. Their transactions are
+	// always rolled back, so it's never reset.
+	sandboxTxn sandboxKind = "txn"
+)
+
+// Sandbox is a team's copy of a sandbox dataset's collections.
+type Sandbox struct {
+	DatasetID string    `json:"dataset_id"`
+	TeamID    string    `json:"team_id"`
+	Kind      string    `json:"kind"`
+	Keyspace  string    `json:"keyspace"`
+	Ready     bool      `json:"ready"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func sandboxDocKey(datasetID, teamID string, kind sandboxKind) string {
+	return fmt.Sprintf("%s::%s::%s", datasetID, teamID, kind)
+}
+
+// sandboxUserRoles are the roles the sandbox user has on the sandbox bucket, and nowhere else. Transactions need the
+// data roles as well as the query ones, for their metadata.
+var sandboxUserRoles = []string{"data_reader", "data_writer", "query_select", "query_insert", "query_update", "query_delete"}
+
+// initSandboxes creates the sandbox bucket, and the sandbox user that players' data-modifying statements run as, which
+// can only get at that bucket.
+func (m *ManagementConnection) initSandboxes(username, password string) error {
+	log.Println("Initialising sandboxes")
+	if err := m.createBucket(m.sandboxBucket, data.BucketSource{}); err != nil {
+		return err
+	}
+	roles := make([]gocb.Role, len(sandboxUserRoles))
+	for i, role := range sandboxUserRoles {
+		roles[i] = gocb.Role{Name: role, Bucket: m.sandboxBucket}
+	}
+	err := m.cluster.Users().UpsertUser(gocb.User{
+		Username:    username,
+		DisplayName: "query-adventure sandboxes",
+		Password:    password,
+		Roles:       roles,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create sandbox user %q: %w", username, err)
+	}
+	return nil
+}
+
+// sandboxKeyspace returns the keyspace for one of the team's sandboxes, which is a scope in the sandbox bucket.
+func (m *ManagementConnection) sandboxKeyspace(ds data.Dataset, teamID string, kind sandboxKind) string {
+	return fmt.Sprintf("%s.%s_%s_%s", m.sandboxBucket, kind, idTag(teamID), idTag(ds.ID))
+}
+
+// Sandbox returns the keyspace of the team's sandbox for the dataset, creating it if this is the first time the team
+// has needed it. It returns ErrSandboxNotReady if another request is already creating it.
+func (m *ManagementConnection) Sandbox(ctx context.Context, ds data.Dataset, teamID string) (string, error) {
+	keyspace, _, err := m.ensureSandbox(ctx, ds, teamID, sandboxPlay)
+	return keyspace, err
+}
+
+// ResetSandbox puts the team's sandbox back to a fresh copy of the dataset.
+func (m *ManagementConnection) ResetSandbox(ctx context.Context, ds data.Dataset, teamID string) error {
+	_, err := m.freshSandbox(ctx, ds, teamID, sandboxPlay)
+	return err
+}
+
+// TransactionSandbox returns the keyspace of the team's copy of the dataset that submissions to its data-modifying
+// challenges run in (see QueryConnection.ExecuteAndVerifyInTransaction), creating it if need be. It returns
+// ErrSandboxNotReady if another request is already creating it.
+func (m *ManagementConnection) TransactionSandbox(ctx context.Context, ds data.Dataset, teamID string) (string, error) {
+	keyspace, _, err := m.ensureSandbox(ctx, ds, teamID, sandboxTxn)
+	return keyspace, err
+}
+
+// freshSandbox is like ensureSandbox, but also resets the sandbox if it already existed.
+func (m *ManagementConnection) freshSandbox(ctx context.Context, ds data.Dataset, teamID string, kind sandboxKind) (string, error) {
+	keyspace, created, err := m.ensureSandbox(ctx, ds, teamID, kind)
+	if err != nil || created {
+		return keyspace, err
+	}
+	return keyspace, m.fillSandbox(ctx, ds, keyspace)
+}
+
+// ensureSandbox returns the keyspace of one of the team's sandboxes, and whether it had to be created. The sandbox is
+// recorded before it's created, so that concurrent requests don't both try to create it.
+func (m *ManagementConnection) ensureSandbox(ctx context.Context, ds data.Dataset, teamID string, kind sandboxKind) (string, bool, error) {
+	if !ds.HasSandboxes() {
+		return "", false, fmt.Errorf("dataset %q doesn't have sandboxes", ds.ID)
+	}
+	keyspace := m.sandboxKeyspace(ds, teamID, kind)
+	coll := m.s.Collection(cSandboxes)
+	docKey := sandboxDocKey(ds.ID, teamID, kind)
+	res, err := coll.Get(docKey, &gocb.GetOptions{
+		Context: ctx,
+	})
+	switch {
+	case errors.Is(err, gocb.ErrDocumentNotFound):
+		_, err = coll.Insert(docKey, Sandbox{
+			DatasetID: ds.ID,
+			TeamID:    teamID,
+			Kind:      string(kind),
+			Keyspace:  keyspace,
+			CreatedAt: time.Now(),
+		}, &gocb.InsertOptions{
+			Context: ctx,
+		})
+		if errors.Is(err, gocb.ErrDocumentExists) {
+			return "", false, ErrSandboxNotReady
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("failed to record sandbox: %w", err)
+		}
+	case err != nil:
+		return "", false, fmt.Errorf("failed to get sandbox: %w", err)
+	default:
+		var sb Sandbox
+		if err = res.Content(&sb); err != nil {
+			return "", false, fmt.Errorf("failed to parse sandbox: %w", err)
+		}
+		if sb.Ready {
+			return sb.Keyspace, false, nil
+		}
+		if time.Since(sb.CreatedAt) < sandboxCreateTimeout {
+			return "", false, ErrSandboxNotReady
+		}
+		// Whoever was creating it must have died, so take over. Creating it again is safe, as anything that already
+		// exists is skipped.
+		sb.CreatedAt = time.Now()
+		_, err = coll.Replace(docKey, sb, &gocb.ReplaceOptions{
+			Context: ctx,
+			Cas:     res.Cas(),
+		})
+		if errors.Is(err, gocb.ErrCasMismatch) {
+			return "", false, ErrSandboxNotReady
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("failed to take over sandbox: %w", err)
+		}
+	}
+
+	err = m.createSandbox(ctx, ds, keyspace)
+	if err == nil {
+		_, err = coll.MutateIn(docKey, []gocb.MutateInSpec{
+			gocb.ReplaceSpec("ready", true, nil),
+		}, &gocb.MutateInOptions{
+			Context: ctx,
+		})
+	}
+	if err != nil {
+		_, _ = coll.Remove(docKey, &gocb.RemoveOptions{
+			Context: ctx,
+		})
+		return "", false, fmt.Errorf("failed to create sandbox %s: %w", keyspace, err)
+	}
+	return keyspace, true, nil
+}
+
+// createSandbox creates the sandbox's scope and collections, along with the dataset's indexes on them, then fills it
+// with a copy of the dataset.
+func (m *ManagementConnection) createSandbox(ctx context.Context, ds data.Dataset, keyspace string) error {
+	bucketName, scopeName, _ := strings.Cut(keyspace, ".")
+	bucket := m.cluster.Bucket(bucketName)
+	if err := createScopeAndCollections(bucket, scopeName, ds.Source.Collections); err != nil {
+		return err
+	}
+
+	collections := ds.SandboxCollections()
+	var stmts []string
+	for _, idx := range ds.Indexes {
+		if slices.Contains(collections, idx.Collection) {
+			stmts = append(stmts, idx.CreateStatement())
+		}
+	}
+	if _, err := createDeferredIndexes(bucket.Scope(scopeName), stmts); err != nil {
+		return err
+	}
+	if err := buildDeferredIndexes(m.cluster, bucketName, scopeName, collections); err != nil {
+		return err
+	}
+	for _, coll := range collections {
+		// Primary indexes are named too, so they don't need WatchPrimary (which only looks for #primary).
+		var names []string
+		for _, idx := range ds.Indexes {
+			if idx.Collection == coll {
+				names = append(names, idx.Name)
+			}
+		}
+		err := m.cluster.QueryIndexes().WatchIndexes(bucketName, names, sandboxIndexTimeout, &gocb.WatchQueryIndexOptions{
+			ScopeName:      scopeName,
+			CollectionName: coll,
+			Context:        ctx,
+		})
+		if err != nil {
+			return fmt.Errorf("indexes on %s not online: %w", coll, err)
+		}
+	}
+	return m.fillSandbox(ctx, ds, keyspace)
+}
+
+// fillSandbox replaces the contents of the sandbox's collections with those of the dataset's.
+func (m *ManagementConnection) fillSandbox(ctx context.Context, ds data.Dataset, keyspace string) error {
+	dsBucket, dsScope, _ := strings.Cut(ds.Keyspace, ".")
+	s := m.sandboxScope(keyspace)
+	for _, coll := range ds.SandboxCollections() {
+		stmts := []string{
+			fmt.Sprintf("DELETE FROM `%s`", coll),
+			fmt.Sprintf("INSERT INTO `%s` (KEY k, VALUE v) SELECT META(d).id AS k, d AS v FROM `%s`.`%s`.`%s` AS d", coll, dsBucket, dsScope, coll),
+		}
+		for _, stmt := range stmts {
+			qr, err := s.Query(stmt, &gocb.QueryOptions{
+				Context: ctx,
+				Timeout: sandboxCopyTimeout,
+			})
+			if err == nil {
+				_, err = readAllRows(qr)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to copy %s into %s: %w", coll, keyspace, err)
+			}
+		}
+	}
+	return nil
+}
+
+// VerifySandboxQuery checks a submission to one of a sandbox dataset's challenges. The input and reference statements
+// each run in a fresh sandbox, and then the contents of the challenge's collections are compared. Unlike the rest of
+// the sandbox, the input runs with the sandbox user's credentials, on q.
+//
+// The check sandboxes are shared by all of a team's submissions, so the check rate limit needs to be long enough that
+// one finishes before the next starts.
+func (m *ManagementConnection) VerifySandboxQuery(ctx context.Context, q *QueryConnection, ds data.Dataset, query data.Query, teamID, input string, params data.Params) error {
+	chk, err := m.freshSandbox(ctx, ds, teamID, sandboxCheck)
+	if err != nil {
+		return err
+	}
+	ref, err := m.freshSandbox(ctx, ds, teamID, sandboxRef)
+	if err != nil {
+		return err
+	}
+	refScope := m.sandboxScope(ref)
+	chkScope := m.sandboxScope(chk)
+
+	refQR, err := refScope.Query(query.Query, &gocb.QueryOptions{
+		Context:         ctx,
+		Adhoc:           true,
+		Timeout:         q.queryTimeout,
+		NamedParameters: params,
+	})
+	if err == nil {
+		// Some errors only turn up once the results have been read.
+		_, err = readAllRows(refQR)
+	}
+	if err != nil {
+		return fmt.Errorf("reference query error: %w", err)
+	}
+	_, err = q.ExecuteSandboxQuery(ctx, chk, input, params)
+	if err != nil {
+		return newQueryFailure(err)
+	}
+
+	// The rows are ordered by key, so a strict comparison is right whatever the challenge's verify settings say.
+	verify := query.Verify
+	verify.Order = data.OrderStrict
+	for _, coll := range query.CompareCollections(ds) {
+		stmt := fmt.Sprintf("SELECT META(d).id AS id, d AS doc FROM `%s` AS d ORDER BY META(d).id", coll)
+		refQR, err := refScope.Query(stmt, &gocb.QueryOptions{
+			Context: ctx,
+			Timeout: q.queryTimeout,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read reference %s: %w", coll, err)
+		}
+		chkQR, err := chkScope.Query(stmt, &gocb.QueryOptions{
+			Context: ctx,
+			Timeout: q.queryTimeout,
+		})
+		if err != nil {
+			_ = refQR.Close()
+			return fmt.Errorf("failed to read %s: %w", coll, err)
+		}
+		if _, err = verifyRows(verify, refQR, chkQR); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ManagementConnection) sandboxScope(keyspace string) *gocb.Scope {
+	bucket, scope, _ := strings.Cut(keyspace, ".")
+	return m.cluster.Bucket(bucket).Scope(scope)
+}
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"query-adventure/cfg"
+	"query-adventure/data"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+// Snapshots stores the expected rows of each challenge's reference queries as newline-delimited JSON files, so that
+// submissions can be checked against them without running the reference query again every time. The first line of
+// each file is a snapshotHeader rather than a row.
+type Snapshots struct {
+	dir string
+}
+
+// NewSnapshots returns the snapshot store configured in g. A relative SnapshotsDir is taken relative to the directory
+// containing the datasets file.
+func NewSnapshots(g *cfg.Globals) *Snapshots {
+	dir := g.SnapshotsDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(g.DatasetsPath), dir)
+	}
+	return &Snapshots{dir: dir}
+}
+
+func (s *Snapshots) path(datasetID, queryID string, ref int) string {
+	name := queryID + ".ndjson"
+	if ref > 0 {
+		name = fmt.Sprintf("%s.alt%d.ndjson", queryID, ref)
+	}
+	return filepath.Join(s.dir, datasetID, name)
+}
+
+// errSnapshotStale is returned when opening a snapshot that was taken with a different reference query or verify
+// settings to the challenge's current ones.
+var errSnapshotStale = errors.New("snapshot is out of date")
+
+// snapshotHeader identifies what a snapshot was taken of, so that ones taken before the challenge was changed aren't
+// used.
+type snapshotHeader struct {
+	Hash string `json:"hash"`
+}
+
+// snapshotHash hashes everything that the expected rows depend on: the reference query, and the verify settings
+// (which are also used to check the snapshot for drift).
+func snapshotHash(query data.Query, ref int) string {
+	h := sha256.New()
+	_ = json.NewEncoder(h).Encode(struct {
+		Query  string
+		Verify data.Verify
+	}{query.ReferenceQueries()[ref], query.Verify})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Has returns whether there are up-to-date snapshots for all the query's reference queries. Out-of-date ones are
+// logged, so that it's clear why the reference queries are being run instead.
+func (s *Snapshots) Has(ds data.Dataset, query data.Query) bool {
+	for i := range query.ReferenceQueries() {
+		rows, err := s.open(ds.ID, query, i)
+		if errors.Is(err, errSnapshotStale) {
+			log.Printf("Ignoring snapshot %q, as %s.%s has changed since it was taken", s.path(ds.ID, query.ID, i), ds.ID, query.ID)
+		}
+		if err != nil {
+			return false
+		}
+		_ = rows.Close()
+	}
+	return true
+}
+
+func (s *Snapshots) write(datasetID string, query data.Query, ref int, rows []any) error {
+	path := s.path(datasetID, query.ID, ref)
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+	// Write to a temporary file first so that a submission being checked never sees a half-written snapshot.
+	tmp := path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", tmp, err)
+	}
+	enc := json.NewEncoder(fd)
+	if err = enc.Encode(snapshotHeader{Hash: snapshotHash(query, ref)}); err != nil {
+		_ = fd.Close()
+		return fmt.Errorf("failed to write %q: %w", tmp, err)
+	}
+	for _, row := range rows {
+		if err = enc.Encode(row); err != nil {
+			_ = fd.Close()
+			return fmt.Errorf("failed to write %q: %w", tmp, err)
+		}
+	}
+	if err = fd.Close(); err != nil {
+		return fmt.Errorf("failed to close %q: %w", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// open opens one of the query's snapshots, returning errSnapshotStale if it doesn't match the query any more.
+func (s *Snapshots) open(datasetID string, query data.Query, ref int) (*snapshotRows, error) {
+	path := s.path(datasetID, query.ID, ref)
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot %q: %w", path, err)
+	}
+	dec := json.NewDecoder(fd)
+	var rawHeader json.RawMessage
+	if err = dec.Decode(&rawHeader); err != nil && !errors.Is(err, io.EOF) {
+		_ = fd.Close()
+		return nil, fmt.Errorf("failed to read snapshot %q: %w", path, err)
+	}
+	// Snapshots from before there were headers start with a row instead, which won't have the right hash either.
+	var header snapshotHeader
+	_ = json.Unmarshal(rawHeader, &header)
+	if header.Hash != snapshotHash(query, ref) {
+		_ = fd.Close()
+		return nil, fmt.Errorf("%w: %q", errSnapshotStale, path)
+	}
+	return &snapshotRows{fd: fd, dec: dec}, nil
+}
+
+// snapshotRows is a rowSource that streams rows from a snapshot file.
+type snapshotRows struct {
+	fd  *os.File
+	dec *json.Decoder
+	cur json.RawMessage
+	err error
+}
+
+func (r *snapshotRows) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	r.cur = nil
+	err := r.dec.Decode(&r.cur)
+	if errors.Is(err, io.EOF) {
+		return false
+	}
+	if err != nil {
+		r.err = fmt.Errorf("failed to read snapshot %q: %w", r.fd.Name(), err)
+		return false
+	}
+	return true
+}
+
+func (r *snapshotRows) Row(valuePtr any) error {
+	return json.Unmarshal(r.cur, valuePtr)
+}
+
+func (r *snapshotRows) Close() error {
+	closeErr := r.fd.Close()
+	if r.err != nil {
+		return r.err
+	}
+	return closeErr
+}
+
+// TakeSnapshot runs all the query's reference queries and stores their results.
+func (c *QueryConnection) TakeSnapshot(ctx context.Context, snaps *Snapshots, ds data.Dataset, query data.Query) error {
+	for i, ref := range query.ReferenceQueries() {
+		rows, err := c.ExecuteQuery(ctx, ds.Keyspace, ref)
+		if err != nil {
+			return fmt.Errorf("failed to run reference query %d: %w", i, err)
+		}
+		if err = snaps.write(ds.ID, query, i, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckSnapshotDrift runs all the query's reference queries and checks that their results still match the stored
+// snapshots, using the query's verify settings.
+func (c *QueryConnection) CheckSnapshotDrift(ctx context.Context, snaps *Snapshots, ds data.Dataset, query data.Query) error {
+	ks, err := c.scope(ds.Keyspace)
+	if err != nil {
+		return err
+	}
+	for i, ref := range query.ReferenceQueries() {
+		snap, err := snaps.open(ds.ID, query, i)
+		if err != nil {
+			return err
+		}
+		live, err := ks.Query(ref, &gocb.QueryOptions{
+			Context: ctx,
+			Adhoc:   true,
+			Timeout: c.queryTimeout,
+		})
+		if err != nil {
+			_ = snap.Close()
+			return fmt.Errorf("failed to run reference query %d: %w", i, err)
+		}
+		if _, err = verifyRows(query.Verify, snap, live); err != nil {
+			return fmt.Errorf("reference query %d has drifted from its snapshot: %w", i, err)
+		}
+	}
+	return nil
+}
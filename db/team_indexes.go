@@ -0,0 +1,291 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"time"
+
+	"query-adventure/data"
+
+	"github.com/couchbase/gocb/v2"
+	"go.uber.org/multierr"
+)
+
+var (
+	// ErrIndexQuotaExceeded is returned by CreateTeamIndex when the team already has as many indexes as it's allowed.
+	ErrIndexQuotaExceeded = errors.New("index quota exceeded")
+	// ErrTeamIndexExists is returned by CreateTeamIndex when the team already has an index with that name.
+	ErrTeamIndexExists = errors.New("team index already exists")
+	// ErrTeamIndexNotFound is returned by DropTeamIndex when the team has no index with that name.
+	ErrTeamIndexNotFound = errors.New("team index not found")
+	// ErrNoSuchCollection is returned by CreateTeamIndex when the dataset has no collection with that name.
+	ErrNoSuchCollection = errors.New("no such collection")
+)
+
+// TeamIndex is an index that a team created on one of the datasets.
+type TeamIndex struct {
+	// Name is the name the team gave the index, and IndexName is its actual name on the cluster, which is prefixed so
+	// that teams can't clash with each other (or the dataset's own indexes).
+	Name       string    `json:"name"`
+	IndexName  string    `json:"index_name"`
+	TeamID     string    `json:"team_id"`
+	DatasetID  string    `json:"dataset_id"`
+	Keyspace   string    `json:"keyspace"`
+	Collection string    `json:"collection"`
+	Keys       []string  `json:"keys"`
+	Where      string    `json:"where,omitempty"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// idTag is a short, identifier-safe stand-in for a team or dataset ID, for naming things on the cluster that belong to
+// them.
+func idTag(id string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func teamIndexName(teamID, name string) string {
+	return fmt.Sprintf("team_%s_%s", idTag(teamID), name)
+}
+
+func teamIndexDocKey(datasetID, teamID, name string) string {
+	return fmt.Sprintf("%s::%s::%s", datasetID, teamID, name)
+}
+
+// teamIndexCountKey is the key of the counter of how many indexes the team has, which is what enforces the quota. It
+// has no team_id, so the queries for the indexes themselves don't pick it up.
+func teamIndexCountKey(teamID string) string {
+	return fmt.Sprintf("count::%s", teamID)
+}
+
+// GetTeamIndexes returns all the indexes the team has created, across all datasets.
+func (m *ManagementConnection) GetTeamIndexes(ctx context.Context, teamID string) ([]TeamIndex, error) {
+	return m.queryTeamIndexes(ctx, fmt.Sprintf("SELECT RAW i FROM %s i WHERE team_id = $1", cTeamIndexes), teamID)
+}
+
+func (m *ManagementConnection) queryTeamIndexes(ctx context.Context, query string, args ...any) ([]TeamIndex, error) {
+	qr, err := m.s.Query(query, &gocb.QueryOptions{
+		Context:              ctx,
+		PositionalParameters: args,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute team indexes query: %w", err)
+	}
+	result := make([]TeamIndex, 0)
+	for qr.Next() {
+		var row TeamIndex
+		err = qr.Row(&row)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse team index: %w", err)
+		}
+		result = append(result, row)
+	}
+	err = qr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("team indexes query close: %w", err)
+	}
+	return result, nil
+}
+
+// CreateTeamIndex creates and builds an index for the team on one of the collections in keyspace (the team's sandbox
+// for the dataset), as long as the team has fewer than quota indexes already. The index is recorded before it's
+// created, so that a failure half-way through can't leave behind an index that DropAllTeamIndexes doesn't know about.
+func (m *ManagementConnection) CreateTeamIndex(ctx context.Context, ds data.Dataset, keyspace string, team Team, email string, name, collection string, keys []string, where string, quota int) (TeamIndex, error) {
+	bucket, scope, ok := strings.Cut(keyspace, ".")
+	if !ok {
+		return TeamIndex{}, fmt.Errorf("invalid keyspace %q", keyspace)
+	}
+	exists, err := m.collectionExists(ctx, bucket, scope, collection)
+	if err != nil {
+		return TeamIndex{}, err
+	}
+	if !exists {
+		return TeamIndex{}, ErrNoSuchCollection
+	}
+	if err = m.reserveTeamIndex(ctx, team.ID, quota); err != nil {
+		return TeamIndex{}, err
+	}
+
+	ti := TeamIndex{
+		Name:       name,
+		IndexName:  teamIndexName(team.ID, name),
+		TeamID:     team.ID,
+		DatasetID:  ds.ID,
+		Keyspace:   keyspace,
+		Collection: collection,
+		Keys:       keys,
+		Where:      where,
+		CreatedBy:  email,
+		CreatedAt:  time.Now(),
+	}
+	docKey := teamIndexDocKey(ds.ID, team.ID, name)
+	_, err = m.s.Collection(cTeamIndexes).Insert(docKey, ti, &gocb.InsertOptions{
+		Context: ctx,
+	})
+	if err != nil {
+		m.releaseTeamIndex(ctx, team.ID)
+	}
+	if errors.Is(err, gocb.ErrDocumentExists) {
+		return TeamIndex{}, ErrTeamIndexExists
+	}
+	if err != nil {
+		return TeamIndex{}, fmt.Errorf("failed to record team index: %w", err)
+	}
+
+	idx := data.Index{Name: ti.IndexName, Collection: collection, Keys: keys, Where: where}
+	err = createTeamIndex(idx.CreateStatement(), func(stmt string) error {
+		_, err := m.cluster.Bucket(bucket).Scope(scope).Query(stmt, &gocb.QueryOptions{
+			Context: ctx,
+		})
+		return err
+	}, func() error {
+		return buildDeferredIndexes(m.cluster, bucket, scope, []string{collection})
+	}, func() {
+		_ = m.DropTeamIndex(ctx, ds.ID, team.ID, name)
+	})
+	if err != nil {
+		return TeamIndex{}, err
+	}
+	return ti, nil
+}
+
+// createTeamIndex runs the (deferred) CREATE INDEX statement for a team index that's already been recorded, and then
+// builds it. If either fails, undo is called to drop the record and give back its place in the quota, so the team
+// isn't left paying for an index that doesn't exist. Unlike createDeferredIndexes, this only lets through
+// gocb.ErrIndexExists: the other codes that skips (like 5000) are as likely to be the player's keys being rejected.
+func createTeamIndex(stmt string, query func(stmt string) error, build func() error, undo func()) error {
+	err := query(stmt)
+	if errors.Is(err, gocb.ErrIndexExists) {
+		err = nil
+	}
+	if err != nil {
+		undo()
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	if err = build(); err != nil {
+		undo()
+		return err
+	}
+	return nil
+}
+
+// reserveTeamIndex counts one more index against the team's quota, failing with ErrIndexQuotaExceeded if that takes
+// it over. The counter is updated atomically, so that teammates creating indexes at the same time can't both get the
+// last one.
+func (m *ManagementConnection) reserveTeamIndex(ctx context.Context, teamID string, quota int) error {
+	res, err := m.s.Collection(cTeamIndexes).Binary().Increment(teamIndexCountKey(teamID), &gocb.IncrementOptions{
+		Context: ctx,
+		Initial: 1,
+		Delta:   1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to count team indexes: %w", err)
+	}
+	if res.Content() > uint64(quota) {
+		m.releaseTeamIndex(ctx, teamID)
+		return ErrIndexQuotaExceeded
+	}
+	return nil
+}
+
+// releaseTeamIndex gives back an index reserved by reserveTeamIndex. Failing just leaves the team with one less index
+// than they should have, so the error is only logged.
+func (m *ManagementConnection) releaseTeamIndex(ctx context.Context, teamID string) {
+	_, err := m.s.Collection(cTeamIndexes).Binary().Decrement(teamIndexCountKey(teamID), &gocb.DecrementOptions{
+		Context: ctx,
+		Delta:   1,
+	})
+	if err != nil && !errors.Is(err, gocb.ErrDocumentNotFound) {
+		log.Printf("Failed to release team index for %s: %v", teamID, err)
+	}
+}
+
+// collectionExists returns whether the collection is one of the scope's, according to the cluster.
+func (m *ManagementConnection) collectionExists(ctx context.Context, bucket, scope, collection string) (bool, error) {
+	scopes, err := m.cluster.Bucket(bucket).Collections().GetAllScopes(&gocb.GetAllScopesOptions{
+		Context: ctx,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to list collections: %w", err)
+	}
+	for _, s := range scopes {
+		if s.Name != scope {
+			continue
+		}
+		for _, c := range s.Collections {
+			if c.Name == collection {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// DropTeamIndex drops one of the team's indexes and forgets about it.
+func (m *ManagementConnection) DropTeamIndex(ctx context.Context, datasetID, teamID, name string) error {
+	docKey := teamIndexDocKey(datasetID, teamID, name)
+	res, err := m.s.Collection(cTeamIndexes).Get(docKey, &gocb.GetOptions{
+		Context: ctx,
+	})
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return ErrTeamIndexNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get team index: %w", err)
+	}
+	var ti TeamIndex
+	if err = res.Content(&ti); err != nil {
+		return fmt.Errorf("failed to parse team index: %w", err)
+	}
+	return m.dropTeamIndex(ctx, ti)
+}
+
+func (m *ManagementConnection) dropTeamIndex(ctx context.Context, ti TeamIndex) error {
+	bucket, scope, ok := strings.Cut(ti.Keyspace, ".")
+	if !ok {
+		return fmt.Errorf("invalid keyspace %q", ti.Keyspace)
+	}
+	_, err := m.cluster.Bucket(bucket).Scope(scope).Query(fmt.Sprintf("DROP INDEX `%s` ON `%s`", ti.IndexName, ti.Collection), &gocb.QueryOptions{
+		Context: ctx,
+	})
+	if err != nil && !errors.Is(err, gocb.ErrIndexNotFound) {
+		return fmt.Errorf("failed to drop index %s: %w", ti.IndexName, err)
+	}
+	_, err = m.s.Collection(cTeamIndexes).Remove(teamIndexDocKey(ti.DatasetID, ti.TeamID, ti.Name), &gocb.RemoveOptions{
+		Context: ctx,
+	})
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		// Someone else dropped it at the same time, and they'll have given back its place in the quota.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to forget team index %s: %w", ti.IndexName, err)
+	}
+	m.releaseTeamIndex(ctx, ti.TeamID)
+	return nil
+}
+
+// DropAllTeamIndexes drops every index that any team has created, for cleaning up at the end of an event. It carries on
+// past failures, and returns how many it dropped.
+func (m *ManagementConnection) DropAllTeamIndexes(ctx context.Context) (int, error) {
+	all, err := m.queryTeamIndexes(ctx, fmt.Sprintf("SELECT RAW i FROM %s i WHERE team_id IS NOT MISSING", cTeamIndexes))
+	if err != nil {
+		return 0, err
+	}
+	dropped := 0
+	var errs error
+	for _, ti := range all {
+		if err = m.dropTeamIndex(ctx, ti); err != nil {
+			multierr.AppendInto(&errs, err)
+			continue
+		}
+		dropped++
+	}
+	return dropped, errs
+}
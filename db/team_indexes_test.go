@@ -0,0 +1,76 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/couchbase/gocb/v2"
+)
+
+func TestCreateTeamIndex(t *testing.T) {
+	errBuild := errors.New("build failed")
+	tests := []struct {
+		name      string
+		createErr error
+		buildErr  error
+		wantBuilt bool
+		wantUndo  bool
+		wantErr   error
+	}{
+		{name: "created", wantBuilt: true},
+		{name: "already exists", createErr: fmt.Errorf("create: %w", gocb.ErrIndexExists), wantBuilt: true},
+		{
+			// 5000 is what the index service gives for most failures, and createDeferredIndexes takes it to mean the
+			// index already exists.
+			name:      "generic index failure",
+			createErr: &gocb.QueryError{InnerError: gocb.ErrInternalServerFailure, Errors: []gocb.QueryErrorDesc{{Code: 5000, Message: "GSI CreateIndex() - cause: Fails to create index."}}},
+			wantUndo:  true,
+			wantErr:   gocb.ErrInternalServerFailure,
+		},
+		{
+			name:      "primary index exists code",
+			createErr: &gocb.QueryError{InnerError: gocb.ErrPlanningFailure, Errors: []gocb.QueryErrorDesc{{Code: 4300, Message: "The index #primary already exists."}}},
+			wantUndo:  true,
+			wantErr:   gocb.ErrPlanningFailure,
+		},
+		{
+			name:      "bad key",
+			createErr: &gocb.QueryError{InnerError: gocb.ErrParsingFailure, Errors: []gocb.QueryErrorDesc{{Code: 3000, Message: "syntax error"}}},
+			wantUndo:  true,
+			wantErr:   gocb.ErrParsingFailure,
+		},
+		{name: "build fails", buildErr: errBuild, wantBuilt: true, wantUndo: true, wantErr: errBuild},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const stmt = "CREATE INDEX `team_x_i` ON `hotel`(`city`) WITH {\"defer_build\": true}"
+			var ran string
+			built, undone := false, false
+			err := createTeamIndex(stmt, func(s string) error {
+				ran = s
+				return tt.createErr
+			}, func() error {
+				built = true
+				return tt.buildErr
+			}, func() {
+				undone = true
+			})
+			if ran != stmt {
+				t.Errorf("ran %q, want %q", ran, stmt)
+			}
+			if built != tt.wantBuilt {
+				t.Errorf("built = %t, want %t", built, tt.wantBuilt)
+			}
+			if undone != tt.wantUndo {
+				t.Errorf("undone = %t, want %t", undone, tt.wantUndo)
+			}
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
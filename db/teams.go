@@ -2,8 +2,10 @@ package db
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"query-adventure/data"
 
@@ -117,7 +119,10 @@ func (m *ManagementConnection) GetAllTeamCompleteChallenges(ctx context.Context,
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse all-team CC result: %w", err)
 		}
-		result[row.DatasetID][row.QueryID][row.TeamID] = true
+		// Skip challenges that aren't in allDatasets, e.g. ones that have been removed since they were completed.
+		if teams, ok := result[row.DatasetID][row.QueryID]; ok {
+			teams[row.TeamID] = true
+		}
 	}
 	err = qr.Close()
 	if err != nil {
@@ -152,56 +157,99 @@ func (m *ManagementConnection) GetTeamScores(ctx context.Context) (map[string]fl
 	return result, nil
 }
 
-func (m *ManagementConnection) GetUsedHints(ctx context.Context, datasetID, queryID, teamID string) (uint, error) {
+// UsedHint records one hint that a team has taken, along with the text they were shown (which, for generated hints,
+// was built from the reference query's result at the time).
+type UsedHint struct {
+	Index  int       `json:"index"`
+	Text   string    `json:"text"`
+	UsedAt time.Time `json:"used_at"`
+}
+
+// UsedHints are the hints a team has taken for one challenge, in order.
+type UsedHints []UsedHint
+
+// Indexes returns the indexes (into data.Query.Hints) of the used hints.
+func (u UsedHints) Indexes() []int {
+	result := make([]int, len(u))
+	for i, h := range u {
+		result[i] = h.Index
+	}
+	return result
+}
+
+func (m *ManagementConnection) GetUsedHints(ctx context.Context, datasetID, queryID, teamID string) (UsedHints, error) {
 	result, _, err := m.getUsedHints(ctx, datasetID, queryID, teamID)
 	if errors.Is(err, gocb.ErrDocumentNotFound) {
-		return 0, nil
+		return UsedHints{}, nil
 	}
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	return result, nil
 }
 
-// UseHint marks one hint as used. Returns the current number of hints, whether one was actually used, and the error.
-// Will return (curr, false, nil) if using one more hint would take the team over the max.
-func (m *ManagementConnection) UseHint(ctx context.Context, datasetID, queryID, teamID string, max int) (uint, bool, error) {
+// UseHint records that the team has taken the hint with the given index, which must be the next one. Returns the
+// hints used so far, whether this one was actually recorded, and the error. Will return (curr, false, nil) if the
+// team has already used a different number of hints, e.g. because another member took one at the same time.
+func (m *ManagementConnection) UseHint(ctx context.Context, datasetID, queryID, teamID string, index int, text string) (UsedHints, bool, error) {
 	curr, cas, err := m.getUsedHints(ctx, datasetID, queryID, teamID)
+	hint := UsedHint{
+		Index:  index,
+		Text:   text,
+		UsedAt: time.Now(),
+	}
 	if errors.Is(err, gocb.ErrDocumentNotFound) {
-		if max == 0 {
-			return 0, false, nil
+		if index != 0 {
+			return UsedHints{}, false, nil
 		}
-		_, err = m.s.Collection(cUsedHints).Insert(usedHintsKey(datasetID, queryID, teamID), 1, &gocb.InsertOptions{
+		curr = UsedHints{hint}
+		_, err = m.s.Collection(cUsedHints).Insert(usedHintsKey(datasetID, queryID, teamID), curr, &gocb.InsertOptions{
 			Context: ctx,
 		})
 	} else if err != nil {
-		return 0, false, err
+		return nil, false, err
 	} else {
-		if curr+1 > uint(max) {
-			return 0, false, nil
+		if len(curr) != index {
+			return curr, false, nil
 		}
-		_, err = m.s.Collection(cUsedHints).Replace(usedHintsKey(datasetID, queryID, teamID), curr+1, &gocb.ReplaceOptions{
+		curr = append(curr, hint)
+		_, err = m.s.Collection(cUsedHints).Replace(usedHintsKey(datasetID, queryID, teamID), curr, &gocb.ReplaceOptions{
 			Context: ctx,
 			Cas:     cas,
 		})
 	}
+	if errors.Is(err, gocb.ErrDocumentExists) || errors.Is(err, gocb.ErrCasMismatch) {
+		return curr[:len(curr)-1], false, nil
+	}
 	if err != nil {
-		return 0, false, fmt.Errorf("failed to execute insert/replace: %w", err)
+		return nil, false, fmt.Errorf("failed to execute insert/replace: %w", err)
 	}
-	return curr + 1, true, nil
+	return curr, true, nil
 }
 
-func (m *ManagementConnection) getUsedHints(ctx context.Context, datasetID, queryID, teamID string) (uint, gocb.Cas, error) {
+func (m *ManagementConnection) getUsedHints(ctx context.Context, datasetID, queryID, teamID string) (UsedHints, gocb.Cas, error) {
 	res, err := m.s.Collection(cUsedHints).Get(usedHintsKey(datasetID, queryID, teamID), &gocb.GetOptions{
 		Context: ctx,
 	})
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to get used hints: %w", err)
+		return nil, 0, fmt.Errorf("failed to get used hints: %w", err)
 	}
-	var result uint
-	err = res.Content(&result)
+	var raw json.RawMessage
+	err = res.Content(&raw)
 	if err != nil {
-		return 0, 0, fmt.Errorf("failed to parse used hints: %w", err)
+		return nil, 0, fmt.Errorf("failed to parse used hints: %w", err)
+	}
+	var result UsedHints
+	if err = json.Unmarshal(raw, &result); err != nil {
+		// Older documents only store the number of hints used, which were always taken in order.
+		var count uint
+		if json.Unmarshal(raw, &count) != nil {
+			return nil, 0, fmt.Errorf("failed to parse used hints: %w", err)
+		}
+		result = make(UsedHints, count)
+		for i := range result {
+			result[i].Index = i
+		}
 	}
 	return result, res.Cas(), nil
 }
@@ -6,6 +6,9 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
@@ -16,10 +19,12 @@ import (
 	"query-adventure/data"
 	"query-adventure/db"
 	"query-adventure/rest"
+	"query-adventure/transform"
 )
 
 type RunCmd struct {
-	GoogleCfg cfg.GoogleCfg `embed:"" prefix:"google."`
+	GoogleCfg     cfg.GoogleCfg `embed:"" prefix:"google."`
+	CreateIndexes bool          `help:"create the indexes declared in the datasets file before starting"`
 }
 
 func (r *RunCmd) Run(g *cfg.Globals) error {
@@ -32,11 +37,22 @@ func (r *RunCmd) Run(g *cfg.Globals) error {
 	defer mCB.Close()
 
 	log.Println("Loading datasets...")
-	datasets, err := data.LoadDatasets(g)
+	datasets, err := data.NewStore(g.DatasetsPath)
 	if err != nil {
 		return err
 	}
 
+	if r.CreateIndexes {
+		log.Println("Creating dataset indexes...")
+		for _, ds := range datasets.Get() {
+			if err = mCB.EnsureDatasetIndexes(ds); err != nil {
+				return err
+			}
+		}
+		// Drift doesn't stop the server starting, but it's worth knowing about.
+		_ = reportIndexes(context.TODO(), mCB, datasets.Get())
+	}
+
 	log.Println("Constructing authenticator...")
 	authn, err := auth.NewGoogleAuthenticator(r.GoogleCfg)
 	if err != nil {
@@ -49,9 +65,60 @@ func (r *RunCmd) Run(g *cfg.Globals) error {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Kill, os.Interrupt)
 	defer cancel()
 
+	if g.DatasetsReloadInterval > 0 {
+		go datasets.Watch(ctx, g.DatasetsReloadInterval)
+	}
+	go reloadOnSIGHUP(ctx, datasets)
+
 	return api.Start(ctx)
 }
 
+func reloadOnSIGHUP(ctx context.Context, datasets *data.Store) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		log.Println("Got SIGHUP, reloading datasets...")
+		if err := datasets.Reload(); err != nil {
+			log.Printf("Failed to reload datasets, keeping the old ones: %v", err)
+			continue
+		}
+		log.Println("Reloaded datasets")
+	}
+}
+
+// selectQueries narrows datasets down to the given dataset and query, if set.
+func selectQueries(datasets data.Datasets, datasetID, queryID string) (data.Datasets, error) {
+	if datasetID != "" {
+		ds, ok := datasets.DatasetByID(datasetID)
+		if !ok {
+			return nil, fmt.Errorf("dataset %q not found", datasetID)
+		}
+		datasets = data.Datasets{ds}
+	}
+	if queryID == "" {
+		return datasets, nil
+	}
+	result := make(data.Datasets, 0, len(datasets))
+	for _, ds := range datasets {
+		q, ok := ds.QueryByID(queryID)
+		if !ok {
+			return nil, fmt.Errorf("failed to find query %s.%s", ds.ID, queryID)
+		}
+		ds.Queries = []data.Query{q}
+		result = append(result, ds)
+	}
+	return result, nil
+}
+
+// testSandboxTeam is the team ID that the test command's sandboxes belong to.
+const testSandboxTeam = "test"
+
 type TestCmd struct {
 	Dataset string `help:"which dataset's queries to test - omit to run all"`
 	Query   string `help:"which query in the dataset to test - omit to run alll"`
@@ -71,47 +138,284 @@ func (t *TestCmd) Run(g *cfg.Globals) error {
 	if err != nil {
 		return err
 	}
+	datasets, err = selectQueries(datasets, t.Dataset, t.Query)
+	if err != nil {
+		return err
+	}
+	snaps := db.NewSnapshots(g)
 
-	if t.Dataset != "" {
-		ds, ok := datasets.DatasetByID(t.Dataset)
-		if !ok {
-			return fmt.Errorf("dataset %q not found", t.Dataset)
+	var errs error
+	for _, ds := range datasets {
+		for _, q := range ds.Queries {
+			variants := q.Params
+			if len(variants) == 0 {
+				variants = []data.Params{nil}
+			}
+			for i, ref := range q.ReferenceQueries() {
+				for j, params := range variants {
+					name := fmt.Sprintf("%s.%s", ds.ID, q.ID)
+					if i > 0 {
+						name = fmt.Sprintf("%s (alternative %d)", name, i)
+					}
+					if len(q.Params) > 0 {
+						name = fmt.Sprintf("%s (params %d)", name, j)
+					}
+					start := time.Now()
+					refQuery := q
+					refQuery.Query, refQuery.Alternatives = ref, nil
+					// Data-modifying reference queries mustn't run directly against the dataset.
+					switch {
+					case ds.Sandbox:
+						err = mCB.VerifySandboxQuery(context.TODO(), qCB, ds, refQuery, testSandboxTeam, ref, params)
+					case q.VerifiesInTransaction():
+						var keyspace string
+						keyspace, err = mCB.TransactionSandbox(context.TODO(), ds, testSandboxTeam)
+						if err == nil {
+							err = qCB.ExecuteAndVerifyInTransaction(context.TODO(), keyspace, refQuery, ref, params)
+						}
+					default:
+						_, err = qCB.ExecuteAndVerifyQuery(context.TODO(), ds.Keyspace, refQuery, ref, params)
+					}
+					end := time.Now()
+					if err != nil {
+						log.Printf("FAIL %s: %v", name, err)
+						multierr.AppendInto(&errs, err)
+					} else {
+						log.Printf("OK %s took %v", name, end.Sub(start))
+					}
+				}
+			}
+			if ds.Sandbox || !q.CanSnapshot() || !snaps.Has(ds, q) {
+				continue
+			}
+			err = qCB.CheckSnapshotDrift(context.TODO(), snaps, ds, q)
+			if err != nil {
+				log.Printf("DRIFT %s.%s: %v", ds.ID, q.ID, err)
+				multierr.AppendInto(&errs, err)
+			} else {
+				log.Printf("OK %s.%s matches its snapshot", ds.ID, q.ID)
+			}
 		}
-		datasets = data.Datasets{ds}
 	}
+	return errs
+}
+
+type SnapshotCmd struct {
+	Dataset string `help:"which dataset's queries to snapshot - omit to snapshot all"`
+	Query   string `help:"which query in the dataset to snapshot - omit to snapshot all"`
+}
+
+func (s *SnapshotCmd) Run(g *cfg.Globals) error {
+	log.Println("Connecting to CB...")
+	qCB, mCB, err := db.Connect(g)
+	if err != nil {
+		return err
+	}
+	defer qCB.Close()
+	defer mCB.Close()
+
+	log.Println("Loading datasets...")
+	datasets, err := data.LoadDatasets(g)
+	if err != nil {
+		return err
+	}
+	datasets, err = selectQueries(datasets, s.Dataset, s.Query)
+	if err != nil {
+		return err
+	}
+	snaps := db.NewSnapshots(g)
 
 	var errs error
 	for _, ds := range datasets {
-		var queries []data.Query
-		if t.Query == "" {
-			queries = ds.Queries
-		} else {
-			q, ok := ds.QueryByID(t.Query)
-			if !ok {
-				return fmt.Errorf("failed to find query %s.%s", ds.ID, t.Query)
+		for _, q := range ds.Queries {
+			if ds.Sandbox || !q.CanSnapshot() {
+				log.Printf("SKIP %s.%s: can't be snapshotted", ds.ID, q.ID)
+				continue
 			}
-			queries = []data.Query{q}
-		}
-		for _, q := range queries {
-			start := time.Now()
-			err = qCB.ExecuteAndVerifyQuery(context.TODO(), ds.Keyspace, q.Query, q.Query)
-			end := time.Now()
+			err = qCB.TakeSnapshot(context.TODO(), snaps, ds, q)
 			if err != nil {
 				log.Printf("FAIL %s.%s: %v", ds.ID, q.ID, err)
 				multierr.AppendInto(&errs, err)
 			} else {
-				log.Printf("OK %s.%s took %v", ds.ID, q.ID, end.Sub(start))
+				log.Printf("OK %s.%s", ds.ID, q.ID)
 			}
 		}
 	}
 	return errs
 }
 
+type LoadCmd struct {
+	Dataset        string `help:"which dataset to load - omit to load all that have a source"`
+	Concurrency    int    `default:"32" help:"how many documents to upsert at once"`
+	NoCreateBucket bool   `help:"don't try to create buckets, e.g. on Capella where they have to be created in the UI"`
+}
+
+func (l *LoadCmd) Run(g *cfg.Globals) error {
+	log.Println("Loading datasets...")
+	datasets, err := data.LoadDatasets(g)
+	if err != nil {
+		return err
+	}
+	datasets, err = selectQueries(datasets, l.Dataset, "")
+	if err != nil {
+		return err
+	}
+
+	log.Println("Connecting to CB...")
+	// Loading doesn't touch the management bucket, which might not even exist yet on a fresh cluster.
+	g.DB.ManagementInit = false
+	qCB, mCB, err := db.Connect(g)
+	if err != nil {
+		return err
+	}
+	defer qCB.Close()
+	defer mCB.Close()
+
+	opts := db.LoadOptions{
+		BaseDir:      filepath.Dir(g.DatasetsPath),
+		Concurrency:  l.Concurrency,
+		CreateBucket: !l.NoCreateBucket,
+	}
+	var errs error
+	for _, ds := range datasets {
+		if ds.Source == nil {
+			log.Printf("SKIP %s: no source", ds.ID)
+			continue
+		}
+		err = mCB.LoadDataset(context.TODO(), ds, opts)
+		if err != nil {
+			log.Printf("FAIL %s: %v", ds.ID, err)
+			multierr.AppendInto(&errs, err)
+		} else {
+			log.Printf("OK %s", ds.ID)
+		}
+	}
+	return errs
+}
+
+type IndexesCmd struct {
+	Dataset string `help:"which dataset's indexes to check - omit to check all"`
+	Create  bool   `help:"create any missing indexes before reporting"`
+}
+
+func (i *IndexesCmd) Run(g *cfg.Globals) error {
+	log.Println("Loading datasets...")
+	datasets, err := data.LoadDatasets(g)
+	if err != nil {
+		return err
+	}
+	datasets, err = selectQueries(datasets, i.Dataset, "")
+	if err != nil {
+		return err
+	}
+
+	log.Println("Connecting to CB...")
+	qCB, mCB, err := db.Connect(g)
+	if err != nil {
+		return err
+	}
+	defer qCB.Close()
+	defer mCB.Close()
+
+	if i.Create {
+		for _, ds := range datasets {
+			if err = mCB.EnsureDatasetIndexes(ds); err != nil {
+				return err
+			}
+		}
+	}
+	return reportIndexes(context.TODO(), mCB, datasets)
+}
+
+// reportIndexes logs how each dataset's declared indexes compare to the cluster's, and returns an error if any of them
+// aren't OK.
+func reportIndexes(ctx context.Context, mCB *db.ManagementConnection, datasets data.Datasets) error {
+	var errs error
+	for _, ds := range datasets {
+		report, err := mCB.DatasetIndexReport(ctx, ds)
+		if err != nil {
+			log.Printf("FAIL %s: %v", ds.ID, err)
+			multierr.AppendInto(&errs, err)
+			continue
+		}
+		for _, status := range report {
+			if status.State == db.IndexOK {
+				log.Printf("OK %s: %s.%s", ds.ID, status.Collection, status.Name)
+				continue
+			}
+			log.Printf("%s %s: %s.%s %s", strings.ToUpper(string(status.State)), ds.ID, status.Collection, status.Name, status.Detail)
+			multierr.AppendInto(&errs, fmt.Errorf("index %s.%s.%s is %s", ds.ID, status.Collection, status.Name, status.State))
+		}
+	}
+	return errs
+}
+
+type DropTeamIndexesCmd struct{}
+
+func (d *DropTeamIndexesCmd) Run(g *cfg.Globals) error {
+	log.Println("Connecting to CB...")
+	qCB, mCB, err := db.Connect(g)
+	if err != nil {
+		return err
+	}
+	defer qCB.Close()
+	defer mCB.Close()
+
+	dropped, err := mCB.DropAllTeamIndexes(context.TODO())
+	log.Printf("Dropped %d team indexes", dropped)
+	return err
+}
+
+type TransformCmd struct {
+	Spec string `arg:"" help:"path to the transform spec"`
+}
+
+func (t *TransformCmd) Run(g *cfg.Globals) error {
+	spec, err := transform.LoadSpec(t.Spec)
+	if err != nil {
+		return err
+	}
+	n, err := transform.Run(spec)
+	if err != nil {
+		return err
+	}
+	log.Printf("OK %q: wrote %d documents", t.Spec, n)
+	return nil
+}
+
+type ValidateCmd struct{}
+
+func (v *ValidateCmd) Run(g *cfg.Globals) error {
+	datasets, err := data.ReadDatasetsFile(g.DatasetsPath)
+	if err != nil {
+		return err
+	}
+	err = datasets.Validate()
+	if err != nil {
+		for _, e := range multierr.Errors(err) {
+			log.Printf("FAIL %v", e)
+		}
+		return fmt.Errorf("%q is invalid", g.DatasetsPath)
+	}
+	queries := 0
+	for _, ds := range datasets {
+		queries += len(ds.Queries)
+	}
+	log.Printf("OK %q: %d datasets, %d queries", g.DatasetsPath, len(datasets), queries)
+	return nil
+}
+
 func main() {
 	var CLI struct {
 		cfg.Globals
-		Run  RunCmd  `cmd:""`
-		Test TestCmd `cmd:""`
+		Run             RunCmd             `cmd:""`
+		Test            TestCmd            `cmd:""`
+		Snapshot        SnapshotCmd        `cmd:"" help:"store the expected results of the reference queries"`
+		Validate        ValidateCmd        `cmd:"" help:"check the datasets file without connecting to Couchbase"`
+		Load            LoadCmd            `cmd:"" help:"create the datasets' keyspaces and load their documents from their sources"`
+		Indexes         IndexesCmd         `cmd:"" help:"report on (and optionally create) the indexes declared in the datasets file"`
+		DropTeamIndexes DropTeamIndexesCmd `cmd:"" help:"drop all the indexes that teams have created, at the end of an event"`
+		Transform       TransformCmd       `cmd:"" help:"build a dataset's source documents from CSV files, as described by a transform spec"`
 	}
 	ctx := kong.Parse(&CLI, kong.DefaultEnvars("Q"), kong.Configuration(kong.JSON))
 	err := ctx.Run(&CLI.Globals)
@@ -21,6 +21,7 @@ import (
 	"query-adventure/data"
 	"query-adventure/db"
 	"query-adventure/rest/ratelimit"
+	"query-adventure/sqlpp"
 	"query-adventure/ui"
 )
 
@@ -29,24 +30,28 @@ type API struct {
 	g    *cfg.Globals
 	qCB  *db.QueryConnection
 	mCB  *db.ManagementConnection
-	ds   data.Datasets
+	ds   *data.Store
+	snap *db.Snapshots
 	auth auth.Authenticator
 	am   *auth.Middleware
 	rl   *ratelimit.RateLimiter
 }
 
-func NewAPI(g *cfg.Globals, qCB *db.QueryConnection, mCB *db.ManagementConnection, ds data.Datasets, authn auth.Authenticator) *API {
+func NewAPI(g *cfg.Globals, qCB *db.QueryConnection, mCB *db.ManagementConnection, ds *data.Store, authn auth.Authenticator) *API {
 	a := &API{
 		e:    echo.New(),
 		g:    g,
 		qCB:  qCB,
 		mCB:  mCB,
 		ds:   ds,
+		snap: db.NewSnapshots(g),
 		auth: authn,
 		am:   auth.NewMiddleware(authn),
 		rl: ratelimit.NewRateLimiter(map[ratelimit.Key]time.Duration{
-			rlQuery: g.RateLimits[string(rlQuery)],
-			rlCheck: g.RateLimits[string(rlCheck)],
+			rlQuery:   g.RateLimits[string(rlQuery)],
+			rlCheck:   g.RateLimits[string(rlCheck)],
+			rlIndex:   g.RateLimits[string(rlIndex)],
+			rlExplain: g.RateLimits[string(rlExplain)],
 		}),
 	}
 	a.e.Logger.SetLevel(log.DEBUG)
@@ -74,16 +79,26 @@ func (a *API) Start(ctx context.Context) error {
 
 func (a *API) registerRoutes() {
 	a.e.GET("/api/me", a.handleMe, auth.RequireUser())
+	a.e.PUT("/api/me/locale", a.handleSetLocale, auth.RequireUser())
 
 	a.e.GET("/api/datasets", a.handleGetDatasets, auth.RequireUser())
 	a.e.POST("/api/dataset/:ds/query", a.handleQuery, auth.RequireUser())
+	a.e.POST("/api/dataset/:ds/explain", a.handleExplain, auth.RequireUser())
 	a.e.POST("/api/dataset/:ds/:query/submitAnswer", a.handleSubmitAnswer, auth.RequireUser())
 	a.e.POST("/api/dataset/:ds/:query/useHint", a.handleUseHint, auth.RequireUser())
+	a.e.GET("/api/dataset/:ds/indexes", a.handleGetTeamIndexes, auth.RequireUser())
+	a.e.POST("/api/dataset/:ds/indexes", a.handleCreateTeamIndex, auth.RequireUser())
+	a.e.DELETE("/api/dataset/:ds/indexes/:name", a.handleDropTeamIndex, auth.RequireUser())
+	a.e.POST("/api/dataset/:ds/sandbox/reset", a.handleResetSandbox, auth.RequireUser())
 
 	a.e.GET("/api/scoreboard", a.handleScoreboard, auth.RequireUser())
 	a.e.GET("/api/completedChallenges", a.handleCompletedChallenges, auth.RequireUser())
 	a.e.GET("/api/teams", a.handleTeams, auth.RequireUser())
 
+	a.e.GET("/api/admin/datasetsStatus", a.handleDatasetsStatus, auth.RequireUser(), a.requireAdmin)
+	a.e.POST("/api/admin/reloadDatasets", a.handleReloadDatasets, auth.RequireUser(), a.requireAdmin)
+	a.e.POST("/api/admin/dropTeamIndexes", a.handleDropAllTeamIndexes, auth.RequireUser(), a.requireAdmin)
+
 	a.e.GET("/api/signIn", a.am.HandleSignIn)
 	a.e.POST("/api/signIn", a.am.HandleSignIn)
 	a.e.GET("/api/signIn/redirect", a.am.HandleRedirect)
@@ -94,49 +109,110 @@ func (a *API) registerRoutes() {
 }
 
 func (a *API) handleQuery(c echo.Context) error {
-	ds, ok := a.ds.DatasetByID(c.Param("ds"))
-	if !ok {
-		return echo.NewHTTPError(http.StatusNotFound, "no such dataset")
+	ds, err := a.releasedDataset(c)
+	if err != nil {
+		return err
 	}
 
 	var body struct {
 		Statement string `json:"statement" form:"statement"`
 	}
-	err := c.Bind(&body)
+	err = c.Bind(&body)
 	if err != nil {
 		return err
 	}
 
-	err = a.casQueryLimit(c) // TODO: index creation should be different
+	err = a.checkStatement(body.Statement, ds.Sandbox, ds.Sandbox)
 	if err != nil {
 		return err
 	}
 
-	res, err := a.qCB.ExecuteQuery(c.Request().Context(), ds.Keyspace, body.Statement)
+	err = a.casQueryLimit(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("failed to execute query: %v", err))
+		return err
 	}
 
-	return c.JSON(http.StatusOK, map[string]any{
-		"rows": res,
-	})
+	keyspace := ds.Keyspace
+	if ds.Sandbox {
+		keyspace, err = a.sandboxKeyspace(c, ds)
+		if err != nil {
+			return err
+		}
+	}
+
+	w := &rowsWriter{resp: c.Response()}
+	limits := db.ResultLimits{MaxRows: a.g.QueryMaxRows, MaxBytes: a.g.QueryMaxBytes}
+	truncated, metrics, err := a.qCB.StreamQuery(c.Request().Context(), keyspace, body.Statement, ds.Sandbox, limits, w.writeRow)
+	if err != nil && !w.started {
+		return err
+	}
+	return w.finish(truncated, metrics, err)
+}
+
+// handleExplain returns the plan for the player's statement. Its rate limit is much shorter than the query one, as the
+// statement isn't run, so players can use it to find out why their query is slow without waiting to run it again.
+func (a *API) handleExplain(c echo.Context) error {
+	ds, err := a.releasedDataset(c)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		Statement string `json:"statement" form:"statement"`
+	}
+	err = c.Bind(&body)
+	if err != nil {
+		return err
+	}
+
+	// The EXPLAIN is added for us, so it's optional, and it's the statement being explained that has to be allowed.
+	// Explaining a data-modifying statement doesn't run it, so they're fine here too.
+	stmt := sqlpp.StripExplain(body.Statement)
+	err = a.checkStatement(stmt, true, ds.Sandbox)
+	if err != nil {
+		return err
+	}
+
+	err = a.casExplainLimit(c)
+	if err != nil {
+		return err
+	}
+
+	// Sandbox statements refer to the collections in the team's sandbox, which may have indexes the original doesn't.
+	keyspace := ds.Keyspace
+	if ds.Sandbox {
+		keyspace, err = a.sandboxKeyspace(c, ds)
+		if err != nil {
+			return err
+		}
+	}
+	plan, err := a.qCB.Explain(c.Request().Context(), keyspace, stmt, ds.Sandbox)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, plan)
 }
 
 type CorrectAnswerResponse struct {
-	OK     bool    `json:"ok"`
-	Points float64 `json:"points"`
+	OK      bool             `json:"ok"`
+	Points  float64          `json:"points"`
+	Metrics *db.QueryMetrics `json:"metrics,omitempty"`
 }
 
 func (a *API) handleSubmitAnswer(c echo.Context) error {
-	ds, ok := a.ds.DatasetByID(c.Param("ds"))
+	ds, ok := a.ds.Get().DatasetByID(c.Param("ds"))
 	if !ok {
 		return echo.NewHTTPError(http.StatusNotFound, "no such dataset")
 	}
 	query, ok := ds.QueryByID(c.Param("query"))
-	if !ok {
+	if !ok || !ds.QueryWindow(query).IsReleased(time.Now()) {
 		return echo.NewHTTPError(http.StatusNotFound, "query not found")
 	}
 
+	if ds.QueryWindow(query).IsClosed(time.Now()) {
+		return echo.NewHTTPError(http.StatusForbidden, "this challenge has closed")
+	}
+
 	var body struct {
 		Statement string `json:"statement" form:"statement"`
 	}
@@ -151,29 +227,68 @@ func (a *API) handleSubmitAnswer(c echo.Context) error {
 		return fmt.Errorf("failed to get team: %w", err)
 	}
 
+	_, err = a.checkUnlocked(c.Request().Context(), team, query)
+	if err != nil {
+		return err
+	}
+
 	hints, err := a.mCB.GetUsedHints(c.Request().Context(), ds.ID, query.ID, team.ID)
 	if err != nil {
 		return fmt.Errorf("failed to get hints total: %w", err)
 	}
 
-	err = a.casCheckLimit(c, query)
+	sandboxed := ds.Sandbox || query.VerifiesInTransaction()
+	err = a.checkStatement(body.Statement, sandboxed, sandboxed)
 	if err != nil {
 		return err
 	}
 
-	err = a.qCB.ExecuteAndVerifyQuery(c.Request().Context(), ds.Keyspace, query.Query, body.Statement)
+	err = sqlpp.CheckConstraints(body.Statement, query.MustUse, query.MustNotUse)
+	var syntaxErr *sqlpp.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Failed to parse your query: %v", syntaxErr))
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	err = a.casCheckLimit(c, query)
 	if err != nil {
 		return err
 	}
 
-	cc, err := a.mCB.CompleteChallenge(c.Request().Context(), a.g, ds, query, team, user.Email, body.Statement, hints)
+	var metrics *db.QueryMetrics
+	switch {
+	case ds.Sandbox:
+		params := query.ParamsForTeam(ds.ID, team.ID)
+		err = a.mCB.VerifySandboxQuery(c.Request().Context(), a.qCB, ds, query, team.ID, body.Statement, params)
+	case query.VerifiesInTransaction():
+		var keyspace string
+		keyspace, err = a.mCB.TransactionSandbox(c.Request().Context(), ds, team.ID)
+		if err != nil {
+			return err
+		}
+		params := query.ParamsForTeam(ds.ID, team.ID)
+		err = a.qCB.ExecuteAndVerifyInTransaction(c.Request().Context(), keyspace, query, body.Statement, params)
+	case a.g.VerifyFromSnapshots && query.CanSnapshot() && a.snap.Has(ds, query):
+		metrics, err = a.qCB.ExecuteAndVerifyQueryAgainstSnapshot(c.Request().Context(), a.snap, ds, query, body.Statement)
+	default:
+		params := query.ParamsForTeam(ds.ID, team.ID)
+		metrics, err = a.qCB.ExecuteAndVerifyQuery(c.Request().Context(), ds.Keyspace, query, body.Statement, params)
+	}
+	if err != nil {
+		return &metricsError{err: err, metrics: metrics}
+	}
+
+	cc, err := a.mCB.CompleteChallenge(c.Request().Context(), a.g, ds, query, team, user.Email, body.Statement, hints, metrics)
 	if err != nil {
 		return fmt.Errorf("failed to mark challenge %s.%s as complete: %w", ds.ID, query.ID, err)
 	}
 
 	return c.JSON(http.StatusOK, CorrectAnswerResponse{
-		OK:     true,
-		Points: cc.FinalPoints,
+		OK:      true,
+		Points:  cc.FinalPoints,
+		Metrics: cc.Metrics,
 	})
 }
 
@@ -184,12 +299,22 @@ type apiDataset struct {
 
 type apiQuery struct {
 	data.Query
-	Complete bool `json:"complete"`
-	NumHints int  `json:"numHints"`
+	Complete bool     `json:"complete"`
+	Closed   bool     `json:"closed"`
+	Hints    []string `json:"hints"`
+	NumHints int      `json:"numHints"`
+	// NextHint is the type and cost of the next hint, so players know what they're paying for.
+	NextHint *data.Hint `json:"nextHint,omitempty"`
+}
+
+type apiDatasets struct {
+	Datasets []apiDataset `json:"datasets"`
+	// NextRelease is when the next dataset or challenge will be released, if there are any left to come.
+	NextRelease *time.Time `json:"nextRelease"`
 }
 
 func (a *API) handleGetDatasets(c echo.Context) error {
-	rawData := a.ds
+	rawData := a.ds.Get()
 	user := auth.MustUser(c)
 	team, err := a.mCB.GetTeamForUser(c.Request().Context(), user.Email)
 	if err != nil {
@@ -199,39 +324,158 @@ func (a *API) handleGetDatasets(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to find complete challenges: %w", err)
 	}
+	now := time.Now()
+	locale := a.locale(c, rawData)
 	result := make([]apiDataset, 0, len(rawData))
 	for _, d := range rawData {
+		if !d.IsReleased(now) {
+			continue
+		}
+		d = d.Localize(locale)
 		ds := apiDataset{
 			Dataset: d,
 			Queries: make([]apiQuery, 0, len(d.Queries)),
 		}
 		for _, q := range d.Queries {
+			if !q.IsUnlocked(complete) || !d.QueryWindow(q).IsReleased(now) {
+				continue
+			}
 			usedHints, err := a.mCB.GetUsedHints(c.Request().Context(), d.ID, q.ID, team.ID)
 			if err != nil {
 				return fmt.Errorf("failed to get used hints for %s.%s: %w", ds.ID, q.ID, err)
 			}
-			ds.Queries = append(ds.Queries, makeAPIQuery(d, q, usedHints, complete))
+			ds.Queries = append(ds.Queries, makeAPIQuery(d, q, team, usedHints, complete))
+		}
+		if len(ds.Queries) == 0 && len(d.Queries) > 0 {
+			// Every challenge in this dataset is still locked or unreleased, so don't give it away yet.
+			continue
 		}
 		result = append(result, ds)
 	}
-	return c.JSON(http.StatusOK, result)
+	return c.JSON(http.StatusOK, apiDatasets{
+		Datasets:    result,
+		NextRelease: rawData.NextRelease(now),
+	})
 }
 
-func makeAPIQuery(ds data.Dataset, q data.Query, usedHints uint, complete map[string][]string) apiQuery {
-	return apiQuery{
-		Query:    q.FilterForPublic(usedHints),
+func makeAPIQuery(ds data.Dataset, q data.Query, team db.Team, usedHints db.UsedHints, complete map[string][]string) apiQuery {
+	params := q.ParamsForTeam(ds.ID, team.ID)
+	result := apiQuery{
+		Query:    q.FilterForPublic(params),
+		Hints:    make([]string, 0, len(usedHints)),
 		NumHints: len(q.Hints),
 		Complete: slices.Contains(complete[ds.ID], q.ID),
 	}
+	for _, used := range usedHints {
+		text := used.Text
+		if used.Index < len(q.Hints) && (text == "" || q.Hints[used.Index].Type == data.HintText) {
+			// Text hints are regenerated so that they're in the viewer's locale rather than whoever took them, as are
+			// hints recorded before their text was stored.
+			text = q.Hints[used.Index].Generate(params, nil, false)
+		}
+		result.Hints = append(result.Hints, text)
+	}
+	if len(usedHints) < len(q.Hints) {
+		next := q.Hints[len(usedHints)]
+		result.NextHint = &next
+	}
+	result.Window = ds.QueryWindow(q)
+	result.Closed = result.Window.IsClosed(time.Now())
+	return result
+}
+
+// checkStatement rejects statements that players aren't allowed to run, such as DML (unless allowDML is set) or queries
+// on the management and sandbox buckets, or on datasets that haven't been released yet. Statements that run in one of
+// the team's sandboxes (sandboxed) can only refer to collections by their bare names.
+func (a *API) checkStatement(stmt string, allowDML, sandboxed bool) error {
+	allowed := a.g.AllowedStatements
+	if allowDML {
+		allowed = append(slices.Clone(allowed), a.g.DMLStatements...)
+	}
+	// Other statements run as the query user, who can read everything, so full paths have to be ruled out here.
+	forbidden := append([]string{a.g.DB.ManagementBucket, a.g.DB.SandboxBucket}, a.ds.Get().UnreleasedKeyspaces(time.Now())...)
+	err := sqlpp.CheckStatement(stmt, allowed, forbidden)
+	if err == nil && sandboxed {
+		// Sandbox statements run relative to the team's sandbox scope, so a full keyspace path is the only way to reach
+		// the original datasets or other teams' sandboxes.
+		err = sqlpp.CheckRelativeKeyspaces(stmt)
+	}
+	var syntaxErr *sqlpp.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Failed to parse your query: %v", syntaxErr))
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+// checkUnlocked returns an error if the team hasn't yet completed all the query's prerequisites. Otherwise, it returns
+// the team's complete challenges.
+func (a *API) checkUnlocked(ctx context.Context, team db.Team, query data.Query) (map[string][]string, error) {
+	complete, err := a.mCB.GetTeamCompleteChallenges(ctx, team)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find complete challenges: %w", err)
+	}
+	if !query.IsUnlocked(complete) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "this challenge is locked - complete its prerequisites first")
+	}
+	return complete, nil
+}
+
+// releasedDataset returns the dataset named in the request's path, as long as it's been released. Unreleased datasets
+// are treated as if they don't exist, so that they can't be found by guessing their IDs.
+func (a *API) releasedDataset(c echo.Context) (data.Dataset, error) {
+	ds, ok := a.ds.Get().DatasetByID(c.Param("ds"))
+	if !ok || !ds.IsReleased(time.Now()) {
+		return data.Dataset{}, echo.NewHTTPError(http.StatusNotFound, "no such dataset")
+	}
+	return ds, nil
+}
+
+// sandboxKeyspace returns the keyspace of the user's team's sandbox for the dataset, creating it if need be.
+func (a *API) sandboxKeyspace(c echo.Context, ds data.Dataset) (string, error) {
+	user := auth.MustUser(c)
+	team, err := a.mCB.GetTeamForUser(c.Request().Context(), user.Email)
+	if err != nil {
+		return "", fmt.Errorf("failed to get team: %w", err)
+	}
+	return a.mCB.Sandbox(c.Request().Context(), ds, team.ID)
+}
+
+func (a *API) handleResetSandbox(c echo.Context) error {
+	ds, err := a.releasedDataset(c)
+	if err != nil {
+		return err
+	}
+	if !ds.Sandbox {
+		return echo.NewHTTPError(http.StatusBadRequest, "this dataset doesn't have sandboxes")
+	}
+	user := auth.MustUser(c)
+	team, err := a.mCB.GetTeamForUser(c.Request().Context(), user.Email)
+	if err != nil {
+		return fmt.Errorf("failed to get team: %w", err)
+	}
+	err = a.casQueryLimit(c)
+	if err != nil {
+		return err
+	}
+	err = a.mCB.ResetSandbox(c.Request().Context(), ds, team.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"ok": true,
+	})
 }
 
 func (a *API) handleUseHint(c echo.Context) error {
-	ds, ok := a.ds.DatasetByID(c.Param("ds"))
+	ds, ok := a.ds.Get().DatasetByID(c.Param("ds"))
 	if !ok {
 		return echo.NewHTTPError(http.StatusNotFound, "no such dataset")
 	}
 	query, ok := ds.QueryByID(c.Param("query"))
-	if !ok {
+	if !ok || !ds.QueryWindow(query).IsReleased(time.Now()) {
 		return echo.NewHTTPError(http.StatusNotFound, "query not found")
 	}
 
@@ -241,20 +485,76 @@ func (a *API) handleUseHint(c echo.Context) error {
 		return fmt.Errorf("failed to get team: %w", err)
 	}
 
-	curr, used, err := a.mCB.UseHint(c.Request().Context(), ds.ID, query.ID, team.ID, len(query.Hints))
+	complete, err := a.checkUnlocked(c.Request().Context(), team, query)
+	if err != nil {
+		return err
+	}
+
+	usedHints, err := a.mCB.GetUsedHints(c.Request().Context(), ds.ID, query.ID, team.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get used hints: %w", err)
+	}
+	index := len(usedHints)
+	if index >= len(query.Hints) {
+		return echo.NewHTTPError(http.StatusBadRequest, "all hints already used")
+	}
+	hint := query.Hints[index]
+	query = query.Localize(a.locale(c, a.ds.Get()))
+	params := query.ParamsForTeam(ds.ID, team.ID)
+	var firstRow any
+	var hasRow bool
+	if hint.NeedsReferenceRow() {
+		firstRow, hasRow, err = a.qCB.FirstRow(c.Request().Context(), ds.Keyspace, query.Query, params)
+		if err != nil {
+			return fmt.Errorf("failed to run reference query for hint: %w", err)
+		}
+	}
+
+	curr, used, err := a.mCB.UseHint(c.Request().Context(), ds.ID, query.ID, team.ID, index, hint.Generate(params, firstRow, hasRow))
 	if err != nil {
 		return fmt.Errorf("failed to use hint: %w", err)
 	}
 	if !used {
-		return echo.NewHTTPError(http.StatusBadRequest, "all hints already used")
+		return echo.NewHTTPError(http.StatusConflict, "someone else in your team just took a hint - refresh to see it")
 	}
 
-	complete, err := a.mCB.GetTeamCompleteChallenges(c.Request().Context(), team)
+	return c.JSON(http.StatusOK, makeAPIQuery(ds, query, team, curr, complete))
+}
+
+func (a *API) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := auth.MustUser(c)
+		if !slices.Contains(a.g.Admins, user.Email) {
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
+		return next(c)
+	}
+}
+
+func (a *API) handleReloadDatasets(c echo.Context) error {
+	err := a.ds.Reload()
 	if err != nil {
-		return fmt.Errorf("failed to find complete challenges: %w", err)
+		a.e.Logger.Warnf("failed to reload datasets, keeping the old ones: %v", err)
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("failed to reload datasets: %v", err))
 	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"ok":       true,
+		"datasets": len(a.ds.Get()),
+	})
+}
 
-	return c.JSON(http.StatusOK, makeAPIQuery(ds, query, curr, complete))
+// handleDatasetsStatus reports the outcome of the last datasets reload, including ones triggered by the file watcher or
+// SIGHUP, so that authors can tell if their change actually went live.
+func (a *API) handleDatasetsStatus(c echo.Context) error {
+	lastReload, err := a.ds.LastReload()
+	result := map[string]any{
+		"lastReload": lastReload,
+		"datasets":   len(a.ds.Get()),
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+	return c.JSON(http.StatusOK, result)
 }
 
 func (a *API) handleMe(c echo.Context) error {
@@ -262,13 +562,47 @@ func (a *API) handleMe(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+// metricsError attaches a submitted query's metrics to the reason it was rejected, so that players can see how
+// expensive their query was even when it was wrong.
+type metricsError struct {
+	err     error
+	metrics *db.QueryMetrics
+}
+
+func (e *metricsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *metricsError) Unwrap() error {
+	return e.err
+}
+
 func (a *API) errorHandler(err error, c echo.Context) {
 	var httpErr *echo.HTTPError
-	if errors.As(err, &httpErr) {
-		a.e.DefaultHTTPErrorHandler(httpErr, c)
-		return
+	var verifyErr *db.VerifyError
+	var queryFailure *db.QueryFailure
+	switch {
+	case errors.As(err, &verifyErr):
+		httpErr = echo.NewHTTPError(http.StatusExpectationFailed, verifyErr.Localize(a.locale(c, a.ds.Get())))
+	case errors.As(err, &queryFailure):
+		if queryFailure.Status >= http.StatusInternalServerError {
+			a.e.Logger.Errorf("query failed: %v", queryFailure.Unwrap())
+		}
+		httpErr = echo.NewHTTPError(queryFailure.Status, queryFailure)
+	case errors.Is(err, db.ErrSandboxNotReady):
+		httpErr = echo.NewHTTPError(http.StatusServiceUnavailable, "Your sandbox is still being set up - try again in a minute.")
+	case errors.As(err, &httpErr):
+	default:
+		httpErr = echo.NewHTTPError(http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+	var metricsErr *metricsError
+	if msg, ok := httpErr.Message.(string); ok && errors.As(err, &metricsErr) && metricsErr.metrics != nil {
+		httpErr = echo.NewHTTPError(httpErr.Code, map[string]any{
+			"message": msg,
+			"metrics": metricsErr.metrics,
+		})
 	}
-	a.e.DefaultHTTPErrorHandler(err, c)
+	a.e.DefaultHTTPErrorHandler(httpErr, c)
 }
 
 func (a *API) handleScoreboard(c echo.Context) error {
@@ -280,7 +614,7 @@ func (a *API) handleScoreboard(c echo.Context) error {
 }
 
 func (a *API) handleCompletedChallenges(c echo.Context) error {
-	res, err := a.mCB.GetAllTeamCompleteChallenges(c.Request().Context(), a.ds)
+	res, err := a.mCB.GetAllTeamCompleteChallenges(c.Request().Context(), a.ds.Get().Released(time.Now()))
 	if err != nil {
 		return err
 	}
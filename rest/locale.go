@@ -0,0 +1,61 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/text/language"
+
+	"query-adventure/auth"
+	"query-adventure/data"
+	"query-adventure/db"
+)
+
+// locale picks the locale to show content in for this request. An explicit ?locale= wins, then the user's saved
+// preference, then their browser's Accept-Language, and if none of those are supported we use the default locale.
+func (a *API) locale(c echo.Context, ds data.Datasets) string {
+	supported := []string{a.g.DefaultLocale}
+	supported = append(supported, ds.Locales()...)
+	supported = append(supported, db.VerifyLocales()...)
+	tags := make([]language.Tag, len(supported))
+	for i, locale := range supported {
+		tags[i] = language.Make(locale)
+	}
+
+	var prefs []language.Tag
+	if explicit := c.QueryParam("locale"); explicit != "" {
+		prefs = append(prefs, language.Make(explicit))
+	}
+	if user := auth.User(c); user != nil && user.Locale != "" {
+		prefs = append(prefs, language.Make(user.Locale))
+	}
+	accept, _, _ := language.ParseAcceptLanguage(c.Request().Header.Get("Accept-Language"))
+	prefs = append(prefs, accept...)
+
+	_, i, conf := language.NewMatcher(tags).Match(prefs...)
+	if conf == language.No {
+		return a.g.DefaultLocale
+	}
+	return supported[i]
+}
+
+func (a *API) handleSetLocale(c echo.Context) error {
+	var body struct {
+		Locale string `json:"locale" form:"locale"`
+	}
+	err := c.Bind(&body)
+	if err != nil {
+		return err
+	}
+	if body.Locale != "" {
+		if _, err = language.Parse(body.Locale); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid locale %q", body.Locale))
+		}
+	}
+	err = auth.SetLocale(c, body.Locale)
+	if err != nil {
+		return fmt.Errorf("failed to save locale: %w", err)
+	}
+	return c.JSON(http.StatusOK, auth.MustUser(c))
+}
@@ -5,6 +5,7 @@ import (
 
 	"query-adventure/auth"
 	"query-adventure/data"
+	"query-adventure/db"
 	"query-adventure/rest/ratelimit"
 
 	"github.com/labstack/echo/v4"
@@ -12,12 +13,23 @@ import (
 
 const rlQuery = ratelimit.Key("query")
 const rlCheck = ratelimit.Key("check")
+const rlIndex = ratelimit.Key("index")
+const rlExplain = ratelimit.Key("explain")
 
 func (a *API) casQueryLimit(e echo.Context) error {
 	user := auth.MustUser(e)
 	return a.rl.CheckAndSet(rlQuery, user.Email)
 }
 
+func (a *API) casExplainLimit(e echo.Context) error {
+	user := auth.MustUser(e)
+	return a.rl.CheckAndSet(rlExplain, user.Email)
+}
+
+func (a *API) casIndexLimit(team db.Team) error {
+	return a.rl.CheckAndSet(rlIndex, team.ID)
+}
+
 func (a *API) casCheckLimit(e echo.Context, query data.Query) error {
 	user := auth.MustUser(e)
 	team, err := a.mCB.GetTeamForUser(e.Request().Context(), user.Email)
@@ -0,0 +1,71 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"query-adventure/db"
+)
+
+// rowsWriter streams a query's rows to the client as {"rows": [...], "truncated": false, "metrics": {...}}, so that big
+// results never have to be held in memory. The response is only started once the first row arrives, so that errors
+// before then can still be sent with a proper status code. Errors after that can only go at the end, as a
+// db.QueryFailure in an "error" field.
+type rowsWriter struct {
+	resp    *echo.Response
+	started bool
+}
+
+func (w *rowsWriter) start() error {
+	w.started = true
+	w.resp.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	w.resp.WriteHeader(http.StatusOK)
+	_, err := w.resp.Write([]byte(`{"rows":[`))
+	return err
+}
+
+func (w *rowsWriter) writeRow(row json.RawMessage) error {
+	if !w.started {
+		if err := w.start(); err != nil {
+			return err
+		}
+	} else if _, err := w.resp.Write([]byte(",")); err != nil {
+		return err
+	}
+	_, err := w.resp.Write(row)
+	return err
+}
+
+// finish closes off the response, which is started if there weren't any rows.
+func (w *rowsWriter) finish(truncated bool, metrics *db.QueryMetrics, queryErr error) error {
+	if !w.started {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	tail := fmt.Sprintf(`],"truncated":%t`, truncated)
+	if metrics != nil {
+		m, err := json.Marshal(metrics)
+		if err != nil {
+			return err
+		}
+		tail += `,"metrics":` + string(m)
+	}
+	if queryErr != nil {
+		var failure *db.QueryFailure
+		if !errors.As(queryErr, &failure) {
+			failure = &db.QueryFailure{Message: "Something went wrong running your query."}
+		}
+		msg, err := json.Marshal(failure)
+		if err != nil {
+			return err
+		}
+		tail += `,"error":` + string(msg)
+	}
+	_, err := w.resp.Write([]byte(tail + "}"))
+	return err
+}
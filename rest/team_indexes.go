@@ -0,0 +1,167 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/labstack/echo/v4"
+
+	"query-adventure/auth"
+	"query-adventure/db"
+	"query-adventure/sqlpp"
+)
+
+var (
+	teamIndexNameRe  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,39}$`)
+	collectionNameRe = regexp.MustCompile(`^[A-Za-z0-9_%-]{1,251}$`)
+)
+
+type createIndexRequest struct {
+	Name       string   `json:"name"`
+	Collection string   `json:"collection"`
+	Keys       []string `json:"keys"`
+	Where      string   `json:"where"`
+}
+
+// validate checks the request, and in particular that its expressions are safe to splice into the CREATE INDEX
+// statement.
+func (r createIndexRequest) validate() error {
+	badRequest := func(format string, args ...any) error {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(format, args...))
+	}
+	if !teamIndexNameRe.MatchString(r.Name) {
+		return badRequest("The index name must start with a letter and only contain letters, numbers and underscores.")
+	}
+	if !collectionNameRe.MatchString(r.Collection) {
+		return badRequest("%q isn't a valid collection name.", r.Collection)
+	}
+	if len(r.Keys) == 0 {
+		return badRequest("The index needs at least one key.")
+	}
+	for _, key := range r.Keys {
+		if err := sqlpp.CheckExpression(key); err != nil {
+			return badRequest("Invalid index key %q: %v", key, err)
+		}
+	}
+	if r.Where != "" {
+		if err := sqlpp.CheckExpression(r.Where); err != nil {
+			return badRequest("Invalid WHERE clause: %v", err)
+		}
+	}
+	return nil
+}
+
+type teamIndexesResponse struct {
+	Indexes []db.TeamIndex `json:"indexes"`
+	Quota   int            `json:"quota"`
+	// Used counts the team's indexes across all datasets, as that's what the quota applies to.
+	Used int `json:"used"`
+}
+
+func (a *API) handleGetTeamIndexes(c echo.Context) error {
+	ds, err := a.releasedDataset(c)
+	if err != nil {
+		return err
+	}
+	user := auth.MustUser(c)
+	team, err := a.mCB.GetTeamForUser(c.Request().Context(), user.Email)
+	if err != nil {
+		return fmt.Errorf("failed to get team: %w", err)
+	}
+	all, err := a.mCB.GetTeamIndexes(c.Request().Context(), team.ID)
+	if err != nil {
+		return err
+	}
+	result := teamIndexesResponse{
+		Indexes: make([]db.TeamIndex, 0, len(all)),
+		Quota:   a.g.TeamIndexQuota,
+		Used:    len(all),
+	}
+	for _, ti := range all {
+		if ti.DatasetID == ds.ID {
+			result.Indexes = append(result.Indexes, ti)
+		}
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func (a *API) handleCreateTeamIndex(c echo.Context) error {
+	ds, err := a.releasedDataset(c)
+	if err != nil {
+		return err
+	}
+	// An index on a shared dataset would speed up every team's queries, not just those of the team that made it.
+	if !ds.Sandbox {
+		return echo.NewHTTPError(http.StatusBadRequest, "Indexes can only be created on sandbox datasets, where they only affect your own team's queries.")
+	}
+	var body createIndexRequest
+	err = c.Bind(&body)
+	if err != nil {
+		return err
+	}
+	if err = body.validate(); err != nil {
+		return err
+	}
+
+	user := auth.MustUser(c)
+	team, err := a.mCB.GetTeamForUser(c.Request().Context(), user.Email)
+	if err != nil {
+		return fmt.Errorf("failed to get team: %w", err)
+	}
+	err = a.casIndexLimit(team)
+	if err != nil {
+		return err
+	}
+
+	// The index goes in the team's sandbox, which is where its queries run.
+	keyspace, err := a.mCB.Sandbox(c.Request().Context(), ds, team.ID)
+	if err != nil {
+		return err
+	}
+	ti, err := a.mCB.CreateTeamIndex(c.Request().Context(), ds, keyspace, team, user.Email, body.Name, body.Collection, body.Keys, body.Where, a.g.TeamIndexQuota)
+	switch {
+	case errors.Is(err, db.ErrIndexQuotaExceeded):
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("Your team has already used all %d of its indexes - drop one first.", a.g.TeamIndexQuota))
+	case errors.Is(err, db.ErrNoSuchCollection):
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("There's no %q collection in this dataset.", body.Collection))
+	case errors.Is(err, db.ErrTeamIndexExists):
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("Your team already has an index called %q.", body.Name))
+	case err != nil:
+		return fmt.Errorf("failed to create team index: %w", err)
+	}
+	return c.JSON(http.StatusOK, ti)
+}
+
+func (a *API) handleDropTeamIndex(c echo.Context) error {
+	ds, err := a.releasedDataset(c)
+	if err != nil {
+		return err
+	}
+	user := auth.MustUser(c)
+	team, err := a.mCB.GetTeamForUser(c.Request().Context(), user.Email)
+	if err != nil {
+		return fmt.Errorf("failed to get team: %w", err)
+	}
+	err = a.mCB.DropTeamIndex(c.Request().Context(), ds.ID, team.ID, c.Param("name"))
+	if errors.Is(err, db.ErrTeamIndexNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "index not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to drop team index: %w", err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (a *API) handleDropAllTeamIndexes(c echo.Context) error {
+	dropped, err := a.mCB.DropAllTeamIndexes(c.Request().Context())
+	if err != nil {
+		a.e.Logger.Warnf("failed to drop some team indexes: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("dropped %d team indexes, but some failed: %v", dropped, err))
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"ok":      true,
+		"dropped": dropped,
+	})
+}
@@ -0,0 +1,180 @@
+package sqlpp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Construct is a language feature that a challenge can require or forbid, such as JOIN or a particular function.
+type Construct struct {
+	// Kind is one of the keys of constructKinds, or "FUNCTION".
+	Kind string
+	// Function is the upper-cased function name, for FUNCTION constructs.
+	Function string
+}
+
+type constructKind struct {
+	description string
+	matches     func(tokens []Token, i int) bool
+}
+
+var constructKinds = map[string]constructKind{
+	"JOIN":      {"a JOIN", keyword("JOIN")},
+	"UNNEST":    {"UNNEST", keyword("UNNEST")},
+	"NEST":      {"NEST", keyword("NEST")},
+	"USE KEYS":  {"USE KEYS", useClause("KEYS")},
+	"USE INDEX": {"USE INDEX", useClause("INDEX")},
+	"SUBQUERY":  {"a subquery", subquery},
+	"GROUP BY":  {"GROUP BY", keywordPair("GROUP", "BY")},
+	"ORDER BY":  {"ORDER BY", keywordPair("ORDER", "BY")},
+	"LET":       {"LET", keyword("LET")},
+	"WITH":      {"a common table expression (WITH)", keyword("WITH")},
+	"WINDOW":    {"a window function (OVER)", keyword("OVER")},
+	"ARRAY":     {"an ARRAY expression", keyword("ARRAY")},
+	"SATISFIES": {"a collection predicate (ANY/EVERY ... SATISFIES)", keyword("SATISFIES")},
+	"UNION":     {"UNION", keyword("UNION")},
+	"DISTINCT":  {"DISTINCT", keyword("DISTINCT")},
+}
+
+var functionRe = regexp.MustCompile(`^(?i)function:\s*([A-Za-z_][A-Za-z0-9_]*)$`)
+
+// ParseConstruct parses a construct as written in datasets.yml: either one of the known construct names (such as
+// "JOIN" or "USE KEYS"), or "function:NAME" for a particular function.
+func ParseConstruct(s string) (Construct, error) {
+	if m := functionRe.FindStringSubmatch(strings.TrimSpace(s)); m != nil {
+		return Construct{Kind: "FUNCTION", Function: strings.ToUpper(m[1])}, nil
+	}
+	kind := strings.Join(strings.Fields(strings.ToUpper(s)), " ")
+	if _, ok := constructKinds[kind]; !ok {
+		return Construct{}, fmt.Errorf("unknown construct %q", s)
+	}
+	return Construct{Kind: kind}, nil
+}
+
+func (c *Construct) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	parsed, err := ParseConstruct(s)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	*c = parsed
+	return nil
+}
+
+func (c Construct) String() string {
+	if c.Kind == "FUNCTION" {
+		return "function:" + c.Function
+	}
+	return c.Kind
+}
+
+// Describe returns a human-readable name for the construct, for use in error messages.
+func (c Construct) Describe() string {
+	if c.Kind == "FUNCTION" {
+		return fmt.Sprintf("the %s function", c.Function)
+	}
+	return constructKinds[c.Kind].description
+}
+
+// UsedIn returns whether the construct appears anywhere in the tokens.
+func (c Construct) UsedIn(tokens []Token) bool {
+	matches := constructKinds[c.Kind].matches
+	if c.Kind == "FUNCTION" {
+		matches = functionCall(c.Function)
+	}
+	for i := range tokens {
+		if matches(tokens, i) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConstraintError is returned by CheckConstraints when a statement breaks one of a challenge's rules.
+type ConstraintError struct {
+	Construct Construct
+	Required  bool
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Required {
+		return fmt.Sprintf("This challenge requires you to use %s, but your query doesn't.", e.Construct.Describe())
+	}
+	return fmt.Sprintf("This challenge doesn't allow %s, but your query uses it.", e.Construct.Describe())
+}
+
+// CheckConstraints checks that the statement uses all the mustUse constructs and none of the mustNotUse ones. It
+// returns a *SyntaxError if the statement can't be tokenized, or a *ConstraintError for the first rule it breaks.
+func CheckConstraints(stmt string, mustUse, mustNotUse []Construct) error {
+	if len(mustUse) == 0 && len(mustNotUse) == 0 {
+		return nil
+	}
+	tokens, err := Lex(stmt)
+	if err != nil {
+		return err
+	}
+	for _, c := range mustUse {
+		if !c.UsedIn(tokens) {
+			return &ConstraintError{Construct: c, Required: true}
+		}
+	}
+	for _, c := range mustNotUse {
+		if c.UsedIn(tokens) {
+			return &ConstraintError{Construct: c, Required: false}
+		}
+	}
+	return nil
+}
+
+// isKeywordAt returns whether tokens[i] is the keyword, and isn't a field name (as in `a.join`).
+func isKeywordAt(tokens []Token, i int, kw string) bool {
+	if i >= len(tokens) || !tokens[i].Is(kw) {
+		return false
+	}
+	return i == 0 || !(tokens[i-1].Kind == Punct && tokens[i-1].Text == ".")
+}
+
+func keyword(kw string) func([]Token, int) bool {
+	return func(tokens []Token, i int) bool {
+		return isKeywordAt(tokens, i, kw)
+	}
+}
+
+func keywordPair(first, second string) func([]Token, int) bool {
+	return func(tokens []Token, i int) bool {
+		return isKeywordAt(tokens, i, first) && isKeywordAt(tokens, i+1, second)
+	}
+}
+
+// useClause matches USE KEYS / USE PRIMARY KEYS, or USE INDEX.
+func useClause(what string) func([]Token, int) bool {
+	return func(tokens []Token, i int) bool {
+		if !isKeywordAt(tokens, i, "USE") {
+			return false
+		}
+		if isKeywordAt(tokens, i+1, "PRIMARY") {
+			i++
+		}
+		return isKeywordAt(tokens, i+1, what)
+	}
+}
+
+func subquery(tokens []Token, i int) bool {
+	if tokens[i].Kind != Punct || tokens[i].Text != "(" {
+		return false
+	}
+	return isKeywordAt(tokens, i+1, "SELECT") || isKeywordAt(tokens, i+1, "WITH")
+}
+
+func functionCall(name string) func([]Token, int) bool {
+	return func(tokens []Token, i int) bool {
+		return isKeywordAt(tokens, i, name) && i+1 < len(tokens) &&
+			tokens[i+1].Kind == Punct && tokens[i+1].Text == "("
+	}
+}
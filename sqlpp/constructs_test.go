@@ -0,0 +1,188 @@
+package sqlpp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseConstruct(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Construct
+		wantErr bool
+	}{
+		{in: "JOIN", want: Construct{Kind: "JOIN"}},
+		{in: "join", want: Construct{Kind: "JOIN"}},
+		{in: "use   keys", want: Construct{Kind: "USE KEYS"}},
+		{in: " Group By ", want: Construct{Kind: "GROUP BY"}},
+		{in: "function:array_agg", want: Construct{Kind: "FUNCTION", Function: "ARRAY_AGG"}},
+		{in: "FUNCTION: Regexp_Like", want: Construct{Kind: "FUNCTION", Function: "REGEXP_LIKE"}},
+		{in: "LOOP", wantErr: true},
+		{in: "function:", wantErr: true},
+		{in: "function:1abc", wantErr: true},
+		{in: "function:a b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseConstruct(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseConstruct(%q) = %+v, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseConstruct(%q) failed: %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseConstruct(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConstructUsedIn(t *testing.T) {
+	tests := []struct {
+		construct string
+		stmt      string
+		want      bool
+	}{
+		{construct: "JOIN", stmt: "SELECT * FROM a JOIN b ON a.x = b.y", want: true},
+		{construct: "JOIN", stmt: "SELECT * FROM a INNER join b ON a.x = b.y", want: true},
+		{construct: "JOIN", stmt: "SELECT 'JOIN' FROM a", want: false},
+		{construct: "JOIN", stmt: "SELECT * FROM a -- JOIN b\n", want: false},
+		{construct: "JOIN", stmt: "SELECT * FROM a /* JOIN b */", want: false},
+		{construct: "JOIN", stmt: "SELECT a.`join`, a.join FROM a", want: false},
+		{construct: "JOIN", stmt: "SELECT `JOIN` FROM a", want: false},
+		{construct: "UNNEST", stmt: "SELECT s FROM a UNNEST a.schedule s", want: true},
+		{construct: "NEST", stmt: "SELECT s FROM a UNNEST a.schedule s", want: false},
+		{construct: "NEST", stmt: "SELECT * FROM a NEST b ON KEYS a.ids", want: true},
+		{construct: "USE KEYS", stmt: "SELECT * FROM a USE KEYS 'k'", want: true},
+		{construct: "USE KEYS", stmt: "SELECT * FROM a USE PRIMARY KEYS ['k']", want: true},
+		{construct: "USE KEYS", stmt: "SELECT * FROM a USE INDEX (i)", want: false},
+		{construct: "USE INDEX", stmt: "SELECT * FROM a USE INDEX (i)", want: true},
+		{construct: "SUBQUERY", stmt: "SELECT (SELECT RAW 1) FROM a", want: true},
+		{construct: "SUBQUERY", stmt: "SELECT * FROM a WHERE x IN ( WITH b AS (1) SELECT RAW b)", want: true},
+		{construct: "SUBQUERY", stmt: "SELECT (1 + 2) FROM a", want: false},
+		{construct: "GROUP BY", stmt: "SELECT x FROM a GROUP BY x", want: true},
+		{construct: "GROUP BY", stmt: "SELECT a.group FROM a ORDER BY a.`by`", want: false},
+		{construct: "ORDER BY", stmt: "SELECT x FROM a ORDER\nBY x", want: true},
+		{construct: "WINDOW", stmt: "SELECT RANK() OVER (ORDER BY x) FROM a", want: true},
+		{construct: "ARRAY", stmt: "SELECT ARRAY v FOR v IN a.x END FROM a", want: true},
+		{construct: "ARRAY", stmt: "SELECT a.array FROM a", want: false},
+		{construct: "SATISFIES", stmt: "SELECT * FROM a WHERE ANY v IN a.x SATISFIES v > 1 END", want: true},
+		{construct: "DISTINCT", stmt: "SELECT DISTINCT x FROM a", want: true},
+		{construct: "function:ARRAY_LENGTH", stmt: "SELECT ARRAY_LENGTH(a.x) FROM a", want: true},
+		{construct: "function:ARRAY_LENGTH", stmt: "SELECT array_length (a.x) FROM a", want: true},
+		{construct: "function:ARRAY_LENGTH", stmt: "SELECT a.array_length FROM a", want: false},
+		{construct: "function:ARRAY_LENGTH", stmt: "SELECT ARRAY_LENGTH FROM a", want: false},
+		{construct: "function:ARRAY_LENGTH", stmt: "SELECT a.ARRAY_LENGTH(1) FROM a", want: false},
+		{construct: "function:ARRAY_LENGTH", stmt: "SELECT 'ARRAY_LENGTH(x)' FROM a", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.construct+" in "+tt.stmt, func(t *testing.T) {
+			c, err := ParseConstruct(tt.construct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens, err := Lex(tt.stmt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.UsedIn(tokens); got != tt.want {
+				t.Errorf("UsedIn = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckConstraints(t *testing.T) {
+	join := Construct{Kind: "JOIN"}
+	subquery := Construct{Kind: "SUBQUERY"}
+	arrayAgg := Construct{Kind: "FUNCTION", Function: "ARRAY_AGG"}
+	tests := []struct {
+		name       string
+		stmt       string
+		mustUse    []Construct
+		mustNotUse []Construct
+		// wantBroken is the rule that should be reported as broken, if any.
+		wantBroken *ConstraintError
+		wantSyntax bool
+	}{
+		{name: "no rules", stmt: "SELECT 'unterminated"},
+		{name: "uses required", stmt: "SELECT * FROM a JOIN b ON a.x = b.y", mustUse: []Construct{join}},
+		{
+			name:       "missing required",
+			stmt:       "SELECT * FROM a WHERE a.x IN (SELECT RAW y FROM b)",
+			mustUse:    []Construct{join},
+			wantBroken: &ConstraintError{Construct: join, Required: true},
+		},
+		{
+			name:       "required only in a comment",
+			stmt:       "SELECT * FROM a /* JOIN */",
+			mustUse:    []Construct{join},
+			wantBroken: &ConstraintError{Construct: join, Required: true},
+		},
+		{
+			name:       "uses forbidden",
+			stmt:       "SELECT * FROM a WHERE a.x IN (SELECT RAW y FROM b)",
+			mustNotUse: []Construct{subquery},
+			wantBroken: &ConstraintError{Construct: subquery, Required: false},
+		},
+		{
+			name:       "forbidden function in lower case",
+			stmt:       "SELECT array_agg(x) FROM a",
+			mustNotUse: []Construct{arrayAgg},
+			wantBroken: &ConstraintError{Construct: arrayAgg, Required: false},
+		},
+		{
+			name:       "required checked before forbidden",
+			stmt:       "SELECT (SELECT RAW 1) FROM a",
+			mustUse:    []Construct{join},
+			mustNotUse: []Construct{subquery},
+			wantBroken: &ConstraintError{Construct: join, Required: true},
+		},
+		{name: "both satisfied", stmt: "SELECT * FROM a JOIN b ON a.x = b.y", mustUse: []Construct{join}, mustNotUse: []Construct{subquery}},
+		{name: "syntax error", stmt: "SELECT * FROM a JOIN 'b", mustUse: []Construct{join}, wantSyntax: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckConstraints(tt.stmt, tt.mustUse, tt.mustNotUse)
+			var syntaxErr *SyntaxError
+			var constraintErr *ConstraintError
+			switch {
+			case tt.wantSyntax:
+				if !errors.As(err, &syntaxErr) {
+					t.Errorf("got %v, want a SyntaxError", err)
+				}
+			case tt.wantBroken != nil:
+				if !errors.As(err, &constraintErr) || *constraintErr != *tt.wantBroken {
+					t.Errorf("got %v, want %v", err, tt.wantBroken)
+				}
+			case err != nil:
+				t.Errorf("got %v, want no error", err)
+			}
+		})
+	}
+}
+
+func TestConstraintErrorMessages(t *testing.T) {
+	tests := []struct {
+		err  ConstraintError
+		want string
+	}{
+		{
+			err:  ConstraintError{Construct: Construct{Kind: "JOIN"}, Required: true},
+			want: "This challenge requires you to use a JOIN, but your query doesn't.",
+		},
+		{
+			err:  ConstraintError{Construct: Construct{Kind: "FUNCTION", Function: "ARRAY_AGG"}, Required: false},
+			want: "This challenge doesn't allow the ARRAY_AGG function, but your query uses it.",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Package sqlpp contains just enough of a SQL++ (N1QL) lexer to reason about the structure of players' statements
+// without being fooled by keywords that appear inside strings, comments, or quoted identifiers.
+package sqlpp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type TokenKind int
+
+const (
+	// Word is an unquoted identifier or keyword.
+	Word TokenKind = iota
+	// QuotedIdent is a backtick-quoted identifier, with the quotes removed.
+	QuotedIdent
+	// String is a string literal, with the quotes removed.
+	String
+	Number
+	// Param is a named or positional parameter, such as $country or $1.
+	Param
+	// Punct is an operator or punctuation, such as "(", "." or "||".
+	Punct
+)
+
+type Token struct {
+	Kind TokenKind
+	Text string
+	// Line and Column are 1-based, and count runes rather than bytes.
+	Line   int
+	Column int
+}
+
+// Is returns whether the token is the given (case-insensitive) keyword.
+func (t Token) Is(keyword string) bool {
+	return t.Kind == Word && strings.EqualFold(t.Text, keyword)
+}
+
+// SyntaxError is returned by Lex for statements it can't tokenize, such as ones with an unterminated string.
+type SyntaxError struct {
+	Msg    string
+	Line   int
+	Column int
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at line %d, column %d", e.Msg, e.Line, e.Column)
+}
+
+// multiCharPuncts are the operators longer than one character, longest first.
+var multiCharPuncts = []string{"||", "<=", ">=", "<>", "!=", "=="}
+
+type lexer struct {
+	src    string
+	pos    int
+	line   int
+	column int
+	// comments counts the comments that were skipped.
+	comments int
+}
+
+func (l *lexer) peek(offset int) rune {
+	pos := l.pos
+	for i := 0; i < offset; i++ {
+		if pos >= len(l.src) {
+			return 0
+		}
+		_, size := utf8.DecodeRuneInString(l.src[pos:])
+		pos += size
+	}
+	if pos >= len(l.src) {
+		return 0
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[pos:])
+	return r
+}
+
+func (l *lexer) advance() rune {
+	r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+	l.pos += size
+	if r == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+	return r
+}
+
+func (l *lexer) errorf(line, column int, format string, args ...any) error {
+	return &SyntaxError{Msg: fmt.Sprintf(format, args...), Line: line, Column: column}
+}
+
+// Lex splits a statement into tokens, skipping whitespace and comments.
+func Lex(stmt string) ([]Token, error) {
+	l := &lexer{src: stmt, line: 1, column: 1}
+	return l.lex()
+}
+
+func (l *lexer) lex() ([]Token, error) {
+	var tokens []Token
+	for l.pos < len(l.src) {
+		r := l.peek(0)
+		line, column := l.line, l.column
+		switch {
+		case unicode.IsSpace(r):
+			l.advance()
+		case r == '-' && l.peek(1) == '-':
+			l.comments++
+			for l.pos < len(l.src) && l.peek(0) != '\n' {
+				l.advance()
+			}
+		case r == '/' && l.peek(1) == '*':
+			l.comments++
+			l.advance()
+			l.advance()
+			for {
+				if l.pos >= len(l.src) {
+					return nil, l.errorf(line, column, "unterminated comment")
+				}
+				if l.peek(0) == '*' && l.peek(1) == '/' {
+					l.advance()
+					l.advance()
+					break
+				}
+				l.advance()
+			}
+		case r == '"' || r == '\'' || r == '`':
+			text, err := l.quoted(r)
+			if err != nil {
+				return nil, err
+			}
+			kind := String
+			if r == '`' {
+				kind = QuotedIdent
+			}
+			tokens = append(tokens, Token{Kind: kind, Text: text, Line: line, Column: column})
+		case r == '$':
+			l.advance()
+			var sb strings.Builder
+			for isWordRune(l.peek(0)) {
+				sb.WriteRune(l.advance())
+			}
+			if sb.Len() == 0 {
+				return nil, l.errorf(line, column, "expected a parameter name after $")
+			}
+			tokens = append(tokens, Token{Kind: Param, Text: sb.String(), Line: line, Column: column})
+		case unicode.IsDigit(r) || (r == '.' && unicode.IsDigit(l.peek(1))):
+			tokens = append(tokens, Token{Kind: Number, Text: l.number(), Line: line, Column: column})
+		case isWordRune(r):
+			var sb strings.Builder
+			for isWordRune(l.peek(0)) {
+				sb.WriteRune(l.advance())
+			}
+			tokens = append(tokens, Token{Kind: Word, Text: sb.String(), Line: line, Column: column})
+		default:
+			text := string(r)
+			for _, p := range multiCharPuncts {
+				if strings.HasPrefix(l.src[l.pos:], p) {
+					text = p
+					break
+				}
+			}
+			for range text {
+				l.advance()
+			}
+			tokens = append(tokens, Token{Kind: Punct, Text: text, Line: line, Column: column})
+		}
+	}
+	return tokens, nil
+}
+
+// escapes are the single-character backslash escapes that the query service understands, as in JSON. A backslash
+// before anything else just stands for that character.
+var escapes = map[rune]rune{'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t'}
+
+// quoted reads a string or quoted identifier. The quote can be escaped either by doubling it or with a backslash, and
+// the other backslash escapes are decoded the way the query service does, so that the text is what the service sees
+// (an identifier can't get past a check by spelling a name with \u escapes).
+func (l *lexer) quoted(quote rune) (string, error) {
+	line, column := l.line, l.column
+	l.advance()
+	var sb strings.Builder
+	for {
+		if l.pos >= len(l.src) {
+			if quote == '`' {
+				return "", l.errorf(line, column, "unterminated quoted identifier")
+			}
+			return "", l.errorf(line, column, "unterminated string")
+		}
+		r := l.advance()
+		switch {
+		case r == '\\' && l.peek(0) == 'u' && isHex(l.peek(1)) && isHex(l.peek(2)) && isHex(l.peek(3)) && isHex(l.peek(4)):
+			l.advance()
+			code, _ := strconv.ParseUint(string([]rune{l.advance(), l.advance(), l.advance(), l.advance()}), 16, 32)
+			sb.WriteRune(rune(code))
+		case r == '\\' && l.pos < len(l.src):
+			escaped := l.advance()
+			if decoded, ok := escapes[escaped]; ok {
+				escaped = decoded
+			}
+			sb.WriteRune(escaped)
+		case r == quote && l.peek(0) == quote:
+			l.advance()
+			sb.WriteRune(quote)
+		case r == quote:
+			return sb.String(), nil
+		default:
+			sb.WriteRune(r)
+		}
+	}
+}
+
+func (l *lexer) number() string {
+	var sb strings.Builder
+	for unicode.IsDigit(l.peek(0)) || l.peek(0) == '.' {
+		sb.WriteRune(l.advance())
+	}
+	if r := l.peek(0); r == 'e' || r == 'E' {
+		next := l.peek(1)
+		if unicode.IsDigit(next) || ((next == '+' || next == '-') && unicode.IsDigit(l.peek(2))) {
+			sb.WriteRune(l.advance())
+			sb.WriteRune(l.advance())
+			for unicode.IsDigit(l.peek(0)) {
+				sb.WriteRune(l.advance())
+			}
+		}
+	}
+	return sb.String()
+}
+
+func isHex(r rune) bool {
+	return unicode.Is(unicode.ASCII_Hex_Digit, r)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,176 @@
+package sqlpp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		name string
+		stmt string
+		want []Token
+	}{
+		{
+			name: "simple select",
+			stmt: "SELECT a FROM b",
+			want: []Token{
+				{Kind: Word, Text: "SELECT", Line: 1, Column: 1},
+				{Kind: Word, Text: "a", Line: 1, Column: 8},
+				{Kind: Word, Text: "FROM", Line: 1, Column: 10},
+				{Kind: Word, Text: "b", Line: 1, Column: 15},
+			},
+		},
+		{
+			name: "strings and quoted identifiers",
+			stmt: "SELECT \"a b\", 'c', `d e`",
+			want: []Token{
+				{Kind: Word, Text: "SELECT", Line: 1, Column: 1},
+				{Kind: String, Text: "a b", Line: 1, Column: 8},
+				{Kind: Punct, Text: ",", Line: 1, Column: 13},
+				{Kind: String, Text: "c", Line: 1, Column: 15},
+				{Kind: Punct, Text: ",", Line: 1, Column: 18},
+				{Kind: QuotedIdent, Text: "d e", Line: 1, Column: 20},
+			},
+		},
+		{
+			name: "doubled and backslashed quotes",
+			stmt: `'it''s' "say \"hi\"" ` + "`a``b`",
+			want: []Token{
+				{Kind: String, Text: "it's", Line: 1, Column: 1},
+				{Kind: String, Text: `say "hi"`, Line: 1, Column: 9},
+				{Kind: QuotedIdent, Text: "a`b", Line: 1, Column: 22},
+			},
+		},
+		{
+			name: "backslash escapes",
+			stmt: `'a\tb\nc' "\u0041\u00e9" ` + "`mg\\u006dt` `\\m`",
+			want: []Token{
+				{Kind: String, Text: "a\tb\nc", Line: 1, Column: 1},
+				{Kind: String, Text: "Aé", Line: 1, Column: 11},
+				{Kind: QuotedIdent, Text: "mgmt", Line: 1, Column: 26},
+				{Kind: QuotedIdent, Text: "m", Line: 1, Column: 38},
+			},
+		},
+		{
+			name: "incomplete unicode escape",
+			stmt: `'\u00g'`,
+			want: []Token{
+				{Kind: String, Text: "u00g", Line: 1, Column: 1},
+			},
+		},
+		{
+			name: "keywords in strings and comments aren't words",
+			stmt: "SELECT 'FROM' -- JOIN\n/* UNNEST */ FROM",
+			want: []Token{
+				{Kind: Word, Text: "SELECT", Line: 1, Column: 1},
+				{Kind: String, Text: "FROM", Line: 1, Column: 8},
+				{Kind: Word, Text: "FROM", Line: 2, Column: 14},
+			},
+		},
+		{
+			name: "multi-line comment",
+			stmt: "a /* x\ny\nz */ b",
+			want: []Token{
+				{Kind: Word, Text: "a", Line: 1, Column: 1},
+				{Kind: Word, Text: "b", Line: 3, Column: 6},
+			},
+		},
+		{
+			name: "numbers",
+			stmt: "1 2.5 .5 1e10 1.5E-3 2e",
+			want: []Token{
+				{Kind: Number, Text: "1", Line: 1, Column: 1},
+				{Kind: Number, Text: "2.5", Line: 1, Column: 3},
+				{Kind: Number, Text: ".5", Line: 1, Column: 7},
+				{Kind: Number, Text: "1e10", Line: 1, Column: 10},
+				{Kind: Number, Text: "1.5E-3", Line: 1, Column: 15},
+				{Kind: Number, Text: "2", Line: 1, Column: 22},
+				{Kind: Word, Text: "e", Line: 1, Column: 23},
+			},
+		},
+		{
+			name: "params",
+			stmt: "$country = $1",
+			want: []Token{
+				{Kind: Param, Text: "country", Line: 1, Column: 1},
+				{Kind: Punct, Text: "=", Line: 1, Column: 10},
+				{Kind: Param, Text: "1", Line: 1, Column: 12},
+			},
+		},
+		{
+			name: "operators",
+			stmt: "a||b<=c>=d<>e!=f==g.h;",
+			want: []Token{
+				{Kind: Word, Text: "a", Line: 1, Column: 1},
+				{Kind: Punct, Text: "||", Line: 1, Column: 2},
+				{Kind: Word, Text: "b", Line: 1, Column: 4},
+				{Kind: Punct, Text: "<=", Line: 1, Column: 5},
+				{Kind: Word, Text: "c", Line: 1, Column: 7},
+				{Kind: Punct, Text: ">=", Line: 1, Column: 8},
+				{Kind: Word, Text: "d", Line: 1, Column: 10},
+				{Kind: Punct, Text: "<>", Line: 1, Column: 11},
+				{Kind: Word, Text: "e", Line: 1, Column: 13},
+				{Kind: Punct, Text: "!=", Line: 1, Column: 14},
+				{Kind: Word, Text: "f", Line: 1, Column: 16},
+				{Kind: Punct, Text: "==", Line: 1, Column: 17},
+				{Kind: Word, Text: "g", Line: 1, Column: 19},
+				{Kind: Punct, Text: ".", Line: 1, Column: 20},
+				{Kind: Word, Text: "h", Line: 1, Column: 21},
+				{Kind: Punct, Text: ";", Line: 1, Column: 22},
+			},
+		},
+		{
+			name: "columns count runes",
+			stmt: "'héllo' x",
+			want: []Token{
+				{Kind: String, Text: "héllo", Line: 1, Column: 1},
+				{Kind: Word, Text: "x", Line: 1, Column: 9},
+			},
+		},
+		{
+			name: "empty",
+			stmt: "  -- nothing here\n",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Lex(tt.stmt)
+			if err != nil {
+				t.Fatalf("Lex(%q) failed: %v", tt.stmt, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lex(%q) =\n%+v\nwant\n%+v", tt.stmt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		stmt string
+		want SyntaxError
+	}{
+		{name: "unterminated string", stmt: "SELECT 'abc", want: SyntaxError{Msg: "unterminated string", Line: 1, Column: 8}},
+		{name: "unterminated double-quoted string", stmt: "SELECT\n  \"abc", want: SyntaxError{Msg: "unterminated string", Line: 2, Column: 3}},
+		{name: "escaped closing quote", stmt: `SELECT 'abc\'`, want: SyntaxError{Msg: "unterminated string", Line: 1, Column: 8}},
+		{name: "unterminated quoted identifier", stmt: "SELECT `abc", want: SyntaxError{Msg: "unterminated quoted identifier", Line: 1, Column: 8}},
+		{name: "unterminated comment", stmt: "SELECT 1 /* abc", want: SyntaxError{Msg: "unterminated comment", Line: 1, Column: 10}},
+		{name: "bare $", stmt: "SELECT $ + 1", want: SyntaxError{Msg: "expected a parameter name after $", Line: 1, Column: 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Lex(tt.stmt)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Lex(%q) returned %v, want a SyntaxError", tt.stmt, err)
+			}
+			if *syntaxErr != tt.want {
+				t.Errorf("Lex(%q) returned %+v, want %+v", tt.stmt, *syntaxErr, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package sqlpp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// statementKeywords are the keywords that start a statement (once any WITH clause has been skipped).
+var statementKeywords = map[string]bool{
+	"SELECT": true, "INSERT": true, "UPSERT": true, "UPDATE": true, "DELETE": true, "MERGE": true,
+}
+
+// StatementError is returned by CheckStatement for statements that players aren't allowed to run.
+type StatementError struct {
+	Msg string
+}
+
+func (e *StatementError) Error() string {
+	return e.Msg
+}
+
+// StatementKind returns the statement's leading keyword, upper-cased, such as SELECT or CREATE. Common table expressions
+// are looked through, so "WITH x AS (...) SELECT ..." is a SELECT, and so are parentheses around the whole statement.
+func StatementKind(tokens []Token) string {
+	i := 0
+	for i < len(tokens) && tokens[i].Kind == Punct && tokens[i].Text == "(" {
+		i++
+	}
+	if i >= len(tokens) || tokens[i].Kind != Word {
+		return ""
+	}
+	if !tokens[i].Is("WITH") {
+		return strings.ToUpper(tokens[i].Text)
+	}
+	// Find the first statement keyword outside the CTEs' parentheses.
+	depth := 0
+	for _, tok := range tokens[i+1:] {
+		switch {
+		case tok.Kind == Punct && tok.Text == "(":
+			depth++
+		case tok.Kind == Punct && tok.Text == ")":
+			depth--
+		case depth == 0 && tok.Kind == Word && statementKeywords[strings.ToUpper(tok.Text)]:
+			return strings.ToUpper(tok.Text)
+		}
+	}
+	return "WITH"
+}
+
+// StripExplain returns the statement without its leading EXPLAIN, if it has one, so that the statement being explained
+// can be checked by itself. A statement that can't be tokenized is returned as it is, for CheckStatement to report.
+func StripExplain(stmt string) string {
+	tokens, err := Lex(stmt)
+	if err != nil || len(tokens) == 0 || !tokens[0].Is("EXPLAIN") {
+		return stmt
+	}
+	l := &lexer{src: stmt, line: 1, column: 1}
+	for l.line != tokens[0].Line || l.column != tokens[0].Column {
+		l.advance()
+	}
+	return stmt[l.pos+len(tokens[0].Text):]
+}
+
+// CheckStatement checks that a player's statement is a single statement of one of the allowed kinds (see
+// StatementKind), and that it doesn't refer to any of the forbidden keyspaces or the system namespace, which would let
+// players see other teams' data. A forbidden keyspace is either a whole bucket, or a bucket.scope. It returns a
+// *SyntaxError if the statement can't be tokenized, or a *StatementError if it isn't allowed.
+func CheckStatement(stmt string, allowed []string, forbidden []string) error {
+	tokens, err := Lex(stmt)
+	if err != nil {
+		return err
+	}
+	for i, tok := range tokens {
+		if tok.Kind == Punct && tok.Text == ";" && i != len(tokens)-1 {
+			return &StatementError{Msg: fmt.Sprintf("Only one statement can be run at a time, but there's a ; before the end at line %d, column %d.", tok.Line, tok.Column)}
+		}
+	}
+	kind := StatementKind(tokens)
+	if kind == "" {
+		return &StatementError{Msg: "Your statement is empty."}
+	}
+	isAllowed := false
+	for _, a := range allowed {
+		if strings.EqualFold(a, kind) {
+			isAllowed = true
+			break
+		}
+	}
+	if !isAllowed {
+		return &StatementError{Msg: fmt.Sprintf("Only %s statements are allowed, but this is a %s.", strings.Join(allowed, "/"), kind)}
+	}
+	for i, tok := range tokens {
+		if tok.Kind != Word && tok.Kind != QuotedIdent {
+			continue
+		}
+		// A field access (like `a.mgmt`) isn't a keyspace reference.
+		if i > 0 && tokens[i-1].Kind == Punct && tokens[i-1].Text == "." {
+			continue
+		}
+		if strings.EqualFold(tok.Text, "system") && i+1 < len(tokens) && tokens[i+1].Kind == Punct && tokens[i+1].Text == ":" {
+			return &StatementError{Msg: "Queries on the system keyspaces aren't allowed."}
+		}
+		for _, keyspace := range forbidden {
+			bucket, scope, hasScope := strings.Cut(keyspace, ".")
+			// Bucket names are case-sensitive, but identifiers can be made case-insensitive (as in `MGMT`i), so this
+			// errs on the side of caution.
+			if !strings.EqualFold(tok.Text, bucket) {
+				continue
+			}
+			if !hasScope {
+				return &StatementError{Msg: fmt.Sprintf("Queries on the %s bucket aren't allowed.", bucket)}
+			}
+			if i+2 < len(tokens) && tokens[i+1].Kind == Punct && tokens[i+1].Text == "." &&
+				(tokens[i+2].Kind == Word || tokens[i+2].Kind == QuotedIdent) && strings.EqualFold(tokens[i+2].Text, scope) {
+				return &StatementError{Msg: fmt.Sprintf("Queries on %s aren't allowed.", keyspace)}
+			}
+		}
+	}
+	return nil
+}
+
+// keyspaceKeywords are the keywords that can be followed by a keyspace reference.
+var keyspaceKeywords = []string{"FROM", "JOIN", "NEST", "INTO", "UPDATE", "USING", "INFER", "KEYSPACE"}
+
+// fromClauseEnds are the keywords that end a FROM clause, after which commas no longer separate keyspace references.
+var fromClauseEnds = []string{
+	"WHERE", "GROUP", "ORDER", "LIMIT", "OFFSET", "LET", "LETTING", "HAVING", "UNION", "INTERSECT", "EXCEPT", "SELECT",
+	"RETURNING", "WINDOW", "SET", "UNSET",
+}
+
+// CheckRelativeKeyspaces checks that the statement only refers to keyspaces by a bare collection name, which is
+// resolved relative to the scope it runs in, rather than by a full path (like bucket.scope.collection or
+// default:bucket) that could reach anywhere on the cluster. Field accesses straight after FROM (as in a correlated
+// subquery's FROM d.children) look the same as paths, so they're rejected too. It returns a *SyntaxError if the
+// statement can't be tokenized, or a *StatementError if it isn't allowed.
+func CheckRelativeKeyspaces(stmt string) error {
+	tokens, err := Lex(stmt)
+	if err != nil {
+		return err
+	}
+	for _, i := range keyspaceReferences(tokens) {
+		if i+1 >= len(tokens) {
+			continue
+		}
+		name, next := tokens[i], tokens[i+1]
+		if (name.Kind == Word || name.Kind == QuotedIdent) && next.Kind == Punct && (next.Text == "." || next.Text == ":") {
+			return &StatementError{Msg: fmt.Sprintf("Refer to collections by their name alone, not by a full path (line %d, column %d) - you can only use the ones in your sandbox.", name.Line, name.Column)}
+		}
+	}
+	return nil
+}
+
+// keyspaceReferences returns the indexes of the tokens that could start a keyspace reference: those straight after
+// one of the keyspaceKeywords, and those after the commas between a FROM clause's terms (as in FROM a, b).
+func keyspaceReferences(tokens []Token) []int {
+	var result []int
+	for i := range tokens {
+		isKeyspaceKeyword := false
+		for _, kw := range keyspaceKeywords {
+			if isKeywordAt(tokens, i, kw) {
+				isKeyspaceKeyword = true
+				break
+			}
+		}
+		if !isKeyspaceKeyword {
+			continue
+		}
+		result = append(result, i+1)
+		if !isKeywordAt(tokens, i, "FROM") {
+			continue
+		}
+		depth := 0
+	clause:
+		for j := i + 1; j < len(tokens); j++ {
+			tok := tokens[j]
+			switch {
+			case tok.Kind == Punct && (tok.Text == "(" || tok.Text == "[" || tok.Text == "{"):
+				depth++
+			case tok.Kind == Punct && (tok.Text == ")" || tok.Text == "]" || tok.Text == "}"):
+				depth--
+				if depth < 0 {
+					break clause
+				}
+			case depth > 0:
+			case tok.Kind == Punct && tok.Text == ";":
+				break clause
+			case tok.Kind == Punct && tok.Text == ",":
+				result = append(result, j+1)
+			case tok.Kind == Word:
+				for _, kw := range fromClauseEnds {
+					if isKeywordAt(tokens, j, kw) {
+						break clause
+					}
+				}
+			}
+		}
+	}
+	return result
+}
+
+// forbiddenExpressionKeywords can't appear in an expression that gets spliced into a statement, as they could be used
+// to change what the statement does (e.g. adding index options with WITH, or a subquery).
+var forbiddenExpressionKeywords = []string{"SELECT", "WITH", "USING", "PARTITION"}
+
+// CheckExpression checks that expr is a single expression that's safe to splice into a statement the server runs on
+// a player's behalf, such as an index key. Comments aren't allowed, as a line comment would swallow whatever comes
+// after the expression in the statement. It returns a *SyntaxError if it can't be tokenized, or a *StatementError if
+// it isn't allowed.
+func CheckExpression(expr string) error {
+	l := &lexer{src: expr, line: 1, column: 1}
+	tokens, err := l.lex()
+	if err != nil {
+		return err
+	}
+	if l.comments > 0 {
+		return &StatementError{Msg: "Comments aren't allowed here."}
+	}
+	if len(tokens) == 0 {
+		return &StatementError{Msg: "The expression is empty."}
+	}
+	depth := 0
+	for i, tok := range tokens {
+		switch {
+		case tok.Kind == Punct && (tok.Text == "(" || tok.Text == "[" || tok.Text == "{"):
+			depth++
+		case tok.Kind == Punct && (tok.Text == ")" || tok.Text == "]" || tok.Text == "}"):
+			depth--
+			if depth < 0 {
+				return &StatementError{Msg: fmt.Sprintf("Unbalanced %s at line %d, column %d.", tok.Text, tok.Line, tok.Column)}
+			}
+		case tok.Kind == Punct && tok.Text == ";":
+			return &StatementError{Msg: fmt.Sprintf("Unexpected ; at line %d, column %d.", tok.Line, tok.Column)}
+		case tok.Kind == Word:
+			for _, kw := range forbiddenExpressionKeywords {
+				if isKeywordAt(tokens, i, kw) {
+					return &StatementError{Msg: fmt.Sprintf("%s isn't allowed here (line %d, column %d).", kw, tok.Line, tok.Column)}
+				}
+			}
+		}
+	}
+	if depth != 0 {
+		return &StatementError{Msg: "Unbalanced brackets."}
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package sqlpp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStatementKind(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{stmt: "SELECT 1", want: "SELECT"},
+		{stmt: "select 1", want: "SELECT"},
+		{stmt: "(SELECT 1)", want: "SELECT"},
+		{stmt: "((delete FROM a))", want: "DELETE"},
+		{stmt: "WITH a AS (SELECT 1) SELECT a", want: "SELECT"},
+		{stmt: "WITH a AS (SELECT 1), b AS (SELECT 2) DELETE FROM c", want: "DELETE"},
+		{stmt: "WITH a AS (SELECT 1)", want: "WITH"},
+		{stmt: "/* DELETE */ SELECT 1", want: "SELECT"},
+		{stmt: "EXPLAIN DELETE FROM a", want: "EXPLAIN"},
+		{stmt: "CREATE INDEX i ON a(x)", want: "CREATE"},
+		{stmt: "", want: ""},
+		{stmt: "-- just a comment", want: ""},
+		{stmt: "'SELECT'", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.stmt, func(t *testing.T) {
+			tokens, err := Lex(tt.stmt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := StatementKind(tokens); got != tt.want {
+				t.Errorf("StatementKind(%q) = %q, want %q", tt.stmt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripExplain(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{stmt: "SELECT 1", want: "SELECT 1"},
+		{stmt: "EXPLAIN SELECT 1", want: " SELECT 1"},
+		{stmt: "explain\nDELETE FROM a", want: "\nDELETE FROM a"},
+		{stmt: "  /* é */ Explain SELECT 'EXPLAIN'", want: " SELECT 'EXPLAIN'"},
+		{stmt: "-- EXPLAIN\nSELECT 1", want: "-- EXPLAIN\nSELECT 1"},
+		{stmt: "SELECT explain FROM a", want: "SELECT explain FROM a"},
+		{stmt: "EXPLAIN 'a", want: "EXPLAIN 'a"},
+		{stmt: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.stmt, func(t *testing.T) {
+			if got := StripExplain(tt.stmt); got != tt.want {
+				t.Errorf("StripExplain(%q) = %q, want %q", tt.stmt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckStatement(t *testing.T) {
+	readOnly := []string{"SELECT", "EXPLAIN", "ADVISE", "INFER"}
+	withDML := append(readOnly, "INSERT", "UPSERT", "UPDATE", "DELETE", "MERGE")
+	tests := []struct {
+		name       string
+		stmt       string
+		allowed    []string
+		wantErr    bool
+		wantSyntax bool
+	}{
+		{name: "select", stmt: "SELECT * FROM hotel", allowed: readOnly},
+		{name: "lower case", stmt: "select * from hotel", allowed: readOnly},
+		{name: "trailing semicolon", stmt: "SELECT 1;", allowed: readOnly},
+		{name: "explain", stmt: "EXPLAIN SELECT * FROM hotel", allowed: readOnly},
+		{name: "delete when read-only", stmt: "DELETE FROM hotel", allowed: readOnly, wantErr: true},
+		{name: "delete with DML", stmt: "DELETE FROM hotel", allowed: withDML},
+		{name: "delete in brackets", stmt: "(DELETE FROM hotel)", allowed: readOnly, wantErr: true},
+		{name: "delete after CTE", stmt: "WITH x AS (SELECT 1) DELETE FROM hotel", allowed: readOnly, wantErr: true},
+		{name: "delete after comment", stmt: "/* SELECT */ DELETE FROM hotel", allowed: readOnly, wantErr: true},
+		{name: "DDL", stmt: "CREATE PRIMARY INDEX ON hotel", allowed: withDML, wantErr: true},
+		{name: "drop", stmt: "DROP INDEX hotel.i", allowed: withDML, wantErr: true},
+		{name: "prepare", stmt: "PREPARE p FROM DELETE FROM hotel", allowed: readOnly, wantErr: true},
+		{name: "execute", stmt: "EXECUTE p", allowed: readOnly, wantErr: true},
+		{name: "transaction", stmt: "BEGIN WORK", allowed: withDML, wantErr: true},
+		{name: "empty", stmt: "  ", allowed: readOnly, wantErr: true},
+		{name: "only a comment", stmt: "-- SELECT 1", allowed: readOnly, wantErr: true},
+		{name: "second statement", stmt: "SELECT 1; DELETE FROM hotel", allowed: readOnly, wantErr: true},
+		{name: "second statement after comment", stmt: "SELECT 1; -- hi\nDELETE FROM hotel", allowed: withDML, wantErr: true},
+		{name: "two semicolons", stmt: "SELECT 1;;", allowed: readOnly, wantErr: true},
+		{name: "semicolon in string", stmt: "SELECT ';DELETE FROM hotel'", allowed: readOnly},
+		{name: "mgmt bucket", stmt: "SELECT * FROM mgmt", allowed: readOnly, wantErr: true},
+		{name: "mgmt bucket quoted", stmt: "SELECT * FROM `mgmt`", allowed: readOnly, wantErr: true},
+		{name: "mgmt bucket with path", stmt: "SELECT * FROM default:mgmt.s.completed", allowed: readOnly, wantErr: true},
+		{name: "mgmt bucket quoted path", stmt: "SELECT * FROM `default`:`mgmt`.`s`.`completed`", allowed: readOnly, wantErr: true},
+		{name: "mgmt bucket after comment", stmt: "SELECT * FROM /* hotel */ mgmt", allowed: readOnly, wantErr: true},
+		{name: "mgmt bucket in subquery", stmt: "SELECT (SELECT RAW c FROM mgmt.s.c) FROM hotel", allowed: readOnly, wantErr: true},
+		{name: "mgmt bucket with backslash", stmt: "SELECT * FROM `mg\\mt`", allowed: readOnly, wantErr: true},
+		{name: "mgmt bucket with unicode escape", stmt: "SELECT * FROM `mg\\u006dt`", allowed: readOnly, wantErr: true},
+		{name: "mgmt bucket case-insensitive", stmt: "SELECT * FROM `MGMT`i", allowed: readOnly, wantErr: true},
+		{name: "mgmt bucket in DML", stmt: "DELETE FROM mgmt.s.completed", allowed: withDML, wantErr: true},
+		{name: "mgmt bucket in merge", stmt: "MERGE INTO hotel USING mgmt.s.c AS s ON s.id = hotel.id WHEN MATCHED THEN DELETE", allowed: withDML, wantErr: true},
+		{name: "mgmt in a string", stmt: "SELECT 'mgmt'", allowed: readOnly},
+		{name: "mgmt in a comment", stmt: "SELECT 1 -- FROM mgmt", allowed: readOnly},
+		{name: "mgmt as a field", stmt: "SELECT h.mgmt FROM hotel h", allowed: readOnly},
+		{name: "another forbidden bucket", stmt: "SELECT * FROM sandboxes.sbx_1_2.hotel", allowed: readOnly, wantErr: true},
+		{name: "forbidden scope", stmt: "SELECT * FROM `travel-sample`.tenants.users", allowed: readOnly, wantErr: true},
+		{name: "forbidden scope with namespace", stmt: "SELECT * FROM default:`travel-sample`.`TENANTS`.users", allowed: readOnly, wantErr: true},
+		{name: "another scope in the bucket", stmt: "SELECT * FROM `travel-sample`.inventory.hotel", allowed: readOnly},
+		{name: "scope name as a collection", stmt: "SELECT * FROM tenants", allowed: readOnly},
+		{name: "system keyspace", stmt: "SELECT * FROM system:keyspaces", allowed: readOnly, wantErr: true},
+		{name: "system keyspace quoted", stmt: "SELECT * FROM `system`:`completed_requests`", allowed: readOnly, wantErr: true},
+		{name: "system keyspace spaced", stmt: "SELECT * FROM system : user_info", allowed: readOnly, wantErr: true},
+		{name: "system keyspace upper case", stmt: "SELECT * FROM SYSTEM:indexes", allowed: readOnly, wantErr: true},
+		{name: "system as a field", stmt: "SELECT h.system FROM hotel h", allowed: readOnly},
+		{name: "unterminated string", stmt: "SELECT 'a", allowed: readOnly, wantSyntax: true},
+		{name: "unterminated comment hiding a statement", stmt: "SELECT 1 /* ; DELETE FROM hotel", allowed: readOnly, wantSyntax: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckStatement(tt.stmt, tt.allowed, []string{"mgmt", "sandboxes", "travel-sample.tenants"})
+			var syntaxErr *SyntaxError
+			var stmtErr *StatementError
+			switch {
+			case tt.wantSyntax:
+				if !errors.As(err, &syntaxErr) {
+					t.Errorf("got %v, want a SyntaxError", err)
+				}
+			case tt.wantErr:
+				if !errors.As(err, &stmtErr) {
+					t.Errorf("got %v, want a StatementError", err)
+				}
+			case err != nil:
+				t.Errorf("got %v, want no error", err)
+			}
+		})
+	}
+}
+
+func TestCheckExpression(t *testing.T) {
+	tests := []struct {
+		name       string
+		expr       string
+		wantErr    bool
+		wantSyntax bool
+	}{
+		{name: "field", expr: "country"},
+		{name: "quoted field", expr: "`first name`"},
+		{name: "nested field", expr: "address.city"},
+		{name: "function", expr: "LOWER(name)"},
+		{name: "comparison", expr: "type = 'hotel' AND (stars >= 3 OR free_parking)"},
+		{name: "array index key", expr: "DISTINCT ARRAY r.ratings.Overall FOR r IN reviews END"},
+		{name: "array with several bindings", expr: "ARRAY [a, b] FOR a IN x, b IN y END"},
+		{name: "object and array literals", expr: "OBJECT_PUT({\"a\": [1, 2]}, \"b\", 3)"},
+		{name: "keywords in strings", expr: "note = 'SELECT; WITH -- /*'"},
+		{name: "select as a field", expr: "doc.`select`"},
+		{name: "empty", expr: " ", wantErr: true},
+		{name: "subquery", expr: "(SELECT RAW 1)", wantErr: true},
+		{name: "subquery in function", expr: "ARRAY_LENGTH((SELECT RAW id FROM mgmt))", wantErr: true},
+		{name: "index options", expr: "name) WITH {\"nodes\": [\"x\"]", wantErr: true},
+		{name: "index options without brackets", expr: "name WITH {\"num_replica\": 3}", wantErr: true},
+		{name: "using", expr: "name USING FTS", wantErr: true},
+		{name: "partition", expr: "name PARTITION BY HASH(name)", wantErr: true},
+		{name: "closing the key list", expr: "name) WHERE (1 = 1", wantErr: true},
+		{name: "unclosed bracket", expr: "LOWER(name", wantErr: true},
+		{name: "unclosed array", expr: "[name", wantErr: true},
+		{name: "unbalanced object", expr: "name}", wantErr: true},
+		{name: "second statement", expr: "name; DROP INDEX x", wantErr: true},
+		{name: "trailing semicolon", expr: "name;", wantErr: true},
+		{name: "line comment", expr: "name --", wantErr: true},
+		{name: "line comment hiding options", expr: "name = 1 --\n", wantErr: true},
+		{name: "block comment", expr: "name /* x */", wantErr: true},
+		{name: "unterminated comment", expr: "name /*", wantSyntax: true},
+		{name: "unterminated string", expr: "name = 'x", wantSyntax: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckExpression(tt.expr)
+			var syntaxErr *SyntaxError
+			var stmtErr *StatementError
+			switch {
+			case tt.wantSyntax:
+				if !errors.As(err, &syntaxErr) {
+					t.Errorf("got %v, want a SyntaxError", err)
+				}
+			case tt.wantErr:
+				if !errors.As(err, &stmtErr) {
+					t.Errorf("got %v, want a StatementError", err)
+				}
+			case err != nil:
+				t.Errorf("got %v, want no error", err)
+			}
+		})
+	}
+}
+
+func TestCheckRelativeKeyspaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		stmt       string
+		wantErr    bool
+		wantSyntax bool
+	}{
+		{name: "select", stmt: "SELECT * FROM hotel"},
+		{name: "quoted", stmt: "SELECT * FROM `hotel` AS h WHERE h.city = 'Paris'"},
+		{name: "delete", stmt: "DELETE FROM hotel WHERE country = 'France'"},
+		{name: "update", stmt: "UPDATE hotel h SET h.a = 1 WHERE h.b.c = 2"},
+		{name: "insert select", stmt: "INSERT INTO hotel (KEY k, VALUE v) SELECT META(a).id AS k, a AS v FROM airline a"},
+		{name: "merge", stmt: "MERGE INTO hotel t USING airline s ON t.id = s.id WHEN MATCHED THEN UPDATE SET t.x = s.x"},
+		{name: "join", stmt: "SELECT * FROM route r JOIN airline a ON r.airlineid = META(a).id"},
+		{name: "comma separated", stmt: "SELECT * FROM route r, airline a WHERE r.airlineid = META(a).id"},
+		{name: "field after from", stmt: "SELECT a.from FROM hotel a"},
+		{name: "paths in select list", stmt: "SELECT h.a.b, h.c FROM hotel h"},
+		{name: "paths after clauses", stmt: "SELECT h.a FROM hotel h WHERE h.b.c = 1 GROUP BY h.a, h.d.e ORDER BY h.a, h.d.e"},
+		{name: "let after from", stmt: "SELECT x FROM hotel h LET x = h.a.b, y = h.c.d"},
+		{name: "from first", stmt: "FROM hotel h SELECT h.a.b, h.c.d"},
+		{name: "unnest then comma", stmt: "SELECT * FROM hotel h UNNEST h.reviews r, airline a"},
+		{name: "commas in function calls", stmt: "SELECT * FROM hotel h USE KEYS ['a', 'b'] WHERE h.x IN [h.a.b, h.c.d]"},
+		{name: "returning", stmt: "DELETE FROM hotel h RETURNING h.a.b, h.c.d"},
+		{name: "set list", stmt: "UPDATE hotel h SET h.a.b = 1, h.c.d = 2"},
+		{name: "subquery", stmt: "SELECT (SELECT RAW a.name FROM airline a) FROM hotel"},
+		{name: "strings and comments", stmt: "SELECT 'FROM travel-sample.inventory.hotel' FROM hotel -- FROM `travel-sample`.inventory"},
+		{name: "full path", stmt: "DELETE FROM `travel-sample`.inventory.hotel", wantErr: true},
+		{name: "two parts", stmt: "SELECT * FROM inventory.hotel", wantErr: true},
+		{name: "namespace", stmt: "SELECT * FROM default:`f1`", wantErr: true},
+		{name: "namespace quoted", stmt: "SELECT * FROM `default`:`f1`.races.races", wantErr: true},
+		{name: "spaced path", stmt: "SELECT * FROM `travel-sample` . inventory . hotel", wantErr: true},
+		{name: "full path in insert source", stmt: "INSERT INTO hotel (KEY k, VALUE v) SELECT META(d).id AS k, d AS v FROM `travel-sample`.inventory.airline d", wantErr: true},
+		{name: "full path in insert target", stmt: "INSERT INTO `travel-sample`.inventory.hotel (KEY, VALUE) VALUES ('k', {})", wantErr: true},
+		{name: "full path in upsert", stmt: "UPSERT INTO f1.races.races (KEY, VALUE) VALUES ('k', {})", wantErr: true},
+		{name: "full path in update", stmt: "UPDATE `travel-sample`.inventory.hotel SET a = 1", wantErr: true},
+		{name: "full path in merge source", stmt: "MERGE INTO hotel t USING f1.races.races s ON t.id = s.id WHEN MATCHED THEN DELETE", wantErr: true},
+		{name: "full path in join", stmt: "SELECT * FROM hotel h JOIN `travel-sample`.inventory.airline a ON h.id = a.id", wantErr: true},
+		{name: "full path in nest", stmt: "SELECT * FROM hotel h NEST f1.races.races r ON KEYS h.ids", wantErr: true},
+		{name: "full path in subquery", stmt: "SELECT (SELECT RAW a FROM f1.races.races a) FROM hotel", wantErr: true},
+		{name: "full path in where subquery", stmt: "DELETE FROM hotel WHERE id IN (SELECT RAW META(a).id FROM f1.races.races a)", wantErr: true},
+		{name: "full path after comma", stmt: "SELECT * FROM hotel h, `travel-sample`.inventory.airline a", wantErr: true},
+		{name: "full path after several commas", stmt: "SELECT * FROM hotel h, route r, default:f1 f", wantErr: true},
+		{name: "full path after unnest and comma", stmt: "SELECT * FROM hotel h UNNEST h.reviews r, f1.races.races f", wantErr: true},
+		{name: "full path after comma in subquery", stmt: "SELECT (SELECT RAW 1 FROM airline a, f1.races.races f) FROM hotel", wantErr: true},
+		{name: "full path in infer", stmt: "INFER `travel-sample`.inventory.hotel", wantErr: true},
+		{name: "correlated subquery", stmt: "SELECT (SELECT RAW c FROM h.children c) FROM hotel h", wantErr: true},
+		{name: "unterminated", stmt: "SELECT * FROM `hotel", wantSyntax: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckRelativeKeyspaces(tt.stmt)
+			var syntaxErr *SyntaxError
+			var stmtErr *StatementError
+			switch {
+			case tt.wantSyntax:
+				if !errors.As(err, &syntaxErr) {
+					t.Errorf("got %v, want a SyntaxError", err)
+				}
+			case tt.wantErr:
+				if !errors.As(err, &stmtErr) {
+					t.Errorf("got %v, want a StatementError", err)
+				}
+			case err != nil:
+				t.Errorf("got %v, want no error", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package transform
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+
+	"query-adventure/data"
+)
+
+type row = map[string]any
+
+// builtTable is a table whose rows have been read and had their lookups and embeds filled in.
+type builtTable struct {
+	spec *Table
+	// columns are the CSV file's columns, in order.
+	columns []string
+	rows    []row
+	byKey   map[string]row
+}
+
+// Run builds the documents described by the spec and writes them to its output file, returning how many there were.
+func Run(spec *Spec) (int, error) {
+	order, err := spec.order()
+	if err != nil {
+		return 0, err
+	}
+	built := make(map[string]*builtTable, len(order))
+	for _, t := range order {
+		bt, err := spec.build(t, built)
+		if err != nil {
+			return 0, fmt.Errorf("table %q: %w", t.Name, err)
+		}
+		built[t.Name] = bt
+	}
+	return spec.writeOutput(built[spec.Output.Table])
+}
+
+func (s *Spec) build(t *Table, built map[string]*builtTable) (*builtTable, error) {
+	columns, rows, err := s.readTable(t)
+	if err != nil {
+		return nil, err
+	}
+	bt := &builtTable{spec: t, columns: columns, rows: rows}
+	if t.Key != "" {
+		bt.byKey = make(map[string]row, len(rows))
+		for _, r := range rows {
+			bt.byKey[keyString(r[t.Key])] = r
+		}
+	}
+
+	for _, l := range t.Lookups {
+		ref := built[l.Table]
+		for _, r := range rows {
+			target, ok := ref.byKey[keyString(r[l.Field])]
+			if !ok || r[l.Field] == nil {
+				if !l.ZeroIfMissing {
+					r[l.As] = nil
+					continue
+				}
+				target = ref.zeroRow()
+			}
+			if l.Select != "" {
+				r[l.As] = target[l.Select]
+			} else {
+				r[l.As] = ref.output(target)
+			}
+		}
+	}
+
+	for _, e := range t.Embeds {
+		children := built[e.Table]
+		byParent := make(map[string][]row)
+		for _, child := range children.rows {
+			k := keyString(child[e.On])
+			byParent[k] = append(byParent[k], child)
+		}
+		for _, r := range rows {
+			r[e.As] = children.embed(e, byParent[keyString(r[t.Key])])
+		}
+	}
+	return bt, nil
+}
+
+// embed turns the rows for one parent into the array to nest in it.
+func (bt *builtTable) embed(e Embed, rows []row) any {
+	if len(rows) == 0 && e.NullIfEmpty {
+		return nil
+	}
+	sortRows := func(rows []row) {
+		if e.OrderBy != "" {
+			slices.SortStableFunc(rows, func(a, b row) bool {
+				return compareValues(a[e.OrderBy], b[e.OrderBy]) < 0
+			})
+		}
+	}
+	outputAll := func(rows []row) []any {
+		result := make([]any, len(rows))
+		for i, r := range rows {
+			result[i] = bt.output(r)
+		}
+		return result
+	}
+	if e.GroupBy == "" {
+		rows = slices.Clone(rows)
+		sortRows(rows)
+		return outputAll(rows)
+	}
+	groups := make(map[string][]row)
+	groupValues := make(map[string]any)
+	for _, r := range rows {
+		k := keyString(r[e.GroupBy])
+		groups[k] = append(groups[k], r)
+		groupValues[k] = r[e.GroupBy]
+	}
+	keys := maps.Keys(groups)
+	slices.SortFunc(keys, func(a, b string) bool {
+		return compareValues(groupValues[a], groupValues[b]) < 0
+	})
+	result := make([]any, len(keys))
+	for i, k := range keys {
+		sortRows(groups[k])
+		result[i] = outputAll(groups[k])
+	}
+	return result
+}
+
+// zeroRow returns a row with each of the table's columns set to its type's zero value, for lookups with ZeroIfMissing.
+func (bt *builtTable) zeroRow() row {
+	result := make(row, len(bt.columns))
+	for _, col := range bt.columns {
+		result[col] = bt.spec.Types[col].zero()
+	}
+	return result
+}
+
+// output returns the row as it should appear in the output, with the table's renames and drops applied.
+func (bt *builtTable) output(r row) row {
+	result := make(row, len(r))
+	for k, v := range r {
+		if slices.Contains(bt.spec.Drop, k) {
+			continue
+		}
+		if renamed, ok := bt.spec.Rename[k]; ok {
+			k = renamed
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// readTable reads the table's CSV file, returning its header and its rows.
+func (s *Spec) readTable(t *Table) ([]string, []row, error) {
+	fd, err := os.Open(s.path(t.File))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open: %w", err)
+	}
+	defer fd.Close()
+	cr := csv.NewReader(fd)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+	var rows []row
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return header, rows, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read: %w", err)
+		}
+		r := make(row, len(header))
+		for i, field := range header {
+			if i >= len(record) {
+				break
+			}
+			r[field], err = s.coerce(t.Types[field], record[i])
+			if err != nil {
+				line, _ := cr.FieldPos(i)
+				return nil, nil, fmt.Errorf("line %d: field %q: %w", line, field, err)
+			}
+		}
+		rows = append(rows, r)
+	}
+}
+
+func (s *Spec) coerce(c Coercion, raw string) (any, error) {
+	isString := c.Type == "" || c.Type == TypeString
+	if !isString && (raw == "" || slices.Contains(s.NullValues, raw)) {
+		return c.defaultValue, nil
+	}
+	return c.apply(raw)
+}
+
+func (s *Spec) writeOutput(bt *builtTable) (int, error) {
+	keyTemplate := data.CollectionSource{Key: s.Output.Key}
+	keys := make(map[string]row, len(bt.rows))
+	for i, r := range bt.rows {
+		doc := bt.output(r)
+		key, err := keyTemplate.KeyFor(doc)
+		if err != nil {
+			return 0, fmt.Errorf("output document %d: %w", i, err)
+		}
+		if _, dup := keys[key]; dup {
+			return 0, fmt.Errorf("duplicate output key %q", key)
+		}
+		keys[key] = doc
+	}
+	sorted := maps.Keys(keys)
+	slices.Sort(sorted)
+	docs := make([]row, len(sorted))
+	for i, key := range sorted {
+		docs[i] = keys[key]
+	}
+
+	path := s.path(s.Output.File)
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create output: %w", err)
+	}
+	defer fd.Close()
+	if err = json.NewEncoder(fd).Encode(docs); err != nil {
+		return 0, fmt.Errorf("failed to write output: %w", err)
+	}
+	return len(docs), fd.Close()
+}
+
+// keyString normalises a key so that rows can be matched up whatever type their key columns were coerced to.
+func keyString(v any) string {
+	return fmt.Sprint(v)
+}
+
+// compareValues orders numbers numerically and everything else by its string form, with nulls first.
+func compareValues(a, b any) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+	af, aNum := toFloat(a)
+	bf, bNum := toFloat(b)
+	if aNum && bNum {
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return strings.Compare(keyString(a), keyString(b))
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,406 @@
+package transform
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestCoerce(t *testing.T) {
+	tests := []struct {
+		name     string
+		coercion Coercion
+		raw      string
+		want     any
+		wantErr  bool
+	}{
+		{name: "untyped", raw: "abc", want: "abc"},
+		{name: "untyped empty", raw: "", want: ""},
+		{name: "string null value", coercion: Coercion{Type: TypeString}, raw: `\N`, want: `\N`},
+		{name: "int", coercion: Coercion{Type: TypeInt}, raw: "42", want: int64(42)},
+		{name: "negative int", coercion: Coercion{Type: TypeInt}, raw: "-7", want: int64(-7)},
+		{name: "int empty", coercion: Coercion{Type: TypeInt}, raw: "", want: nil},
+		{name: "int null value", coercion: Coercion{Type: TypeInt}, raw: `\N`, want: nil},
+		{name: "int default", coercion: Coercion{Type: TypeInt, Default: strPtr("0")}, raw: `\N`, want: int64(0)},
+		{name: "int not a number", coercion: Coercion{Type: TypeInt}, raw: "1.5", wantErr: true},
+		{name: "float", coercion: Coercion{Type: TypeFloat}, raw: "1.5", want: 1.5},
+		{name: "float from int", coercion: Coercion{Type: TypeFloat}, raw: "2", want: 2.0},
+		{name: "float empty", coercion: Coercion{Type: TypeFloat}, raw: "", want: nil},
+		{name: "float not a number", coercion: Coercion{Type: TypeFloat}, raw: "1:23.456", wantErr: true},
+		{name: "bool", coercion: Coercion{Type: TypeBool}, raw: "true", want: true},
+		{name: "bool as number", coercion: Coercion{Type: TypeBool}, raw: "0", want: false},
+		{name: "bool default", coercion: Coercion{Type: TypeBool, Default: strPtr("false")}, raw: "", want: false},
+		{name: "bool invalid", coercion: Coercion{Type: TypeBool}, raw: "yes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &Spec{
+				NullValues: []string{`\N`},
+				Tables:     []Table{{Name: "t", File: "t.csv", Types: map[string]Coercion{"f": tt.coercion}}},
+				Output:     Output{Table: "t", File: "out.json", Key: "%f%"},
+			}
+			// Validating works out the defaults.
+			if err := spec.validate(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := spec.coerce(spec.Tables[0].Types["f"], tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("coerce(%q) = %#v, want an error", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("coerce(%q) failed: %v", tt.raw, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("coerce(%q) = %#v, want %#v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+// runSpec writes the files into a temporary directory, and runs the spec in it, returning the output.
+func runSpec(t *testing.T, spec string, files map[string]string) (any, error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	specPath := filepath.Join(dir, "spec.yml")
+	if err := os.WriteFile(specPath, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadSpec(specPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = Run(s); err != nil {
+		return nil, err
+	}
+	out, err := os.ReadFile(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result any
+	if err = json.Unmarshal(out, &result); err != nil {
+		t.Fatalf("output isn't JSON: %v", err)
+	}
+	return result, nil
+}
+
+func TestRun(t *testing.T) {
+	const circuits = "circuitId,name,country\n1,Silverstone,UK\n2,Monza,Italy\n"
+	const races = "raceId,year,circuitId,name\n10,2020,1,British GP\n11,2020,2,Italian GP\n12,2021,3,Mystery GP\n13,2021,\\N,TBC GP\n"
+	const results = "resultId,raceId,driver,position,lap\n" +
+		"100,10,HAM,1,\\N\n" +
+		"101,10,VER,2,\\N\n" +
+		"102,11,GAS,1,\\N\n" +
+		"103,11,SAI,10,\\N\n" +
+		"104,11,LEC,3,\\N\n"
+	const laps = "raceId,lap,driver,time\n" +
+		"10,2,HAM,91.2\n" +
+		"10,1,VER,92.0\n" +
+		"10,1,HAM,91.5\n" +
+		"10,10,HAM,90.1\n" +
+		"11,1,GAS,85.0\n"
+	tests := []struct {
+		name    string
+		spec    string
+		files   map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "coerce",
+			spec: `
+null_values: ["\\N"]
+tables:
+  - name: circuits
+    file: circuits.csv
+    types: {circuitId: int}
+output: {table: circuits, file: out.json, key: "%circuitId%"}
+`,
+			files: map[string]string{"circuits.csv": "\ufeff" + circuits},
+			want:  `[{"circuitId":1,"name":"Silverstone","country":"UK"},{"circuitId":2,"name":"Monza","country":"Italy"}]`,
+		},
+		{
+			name: "lookup whole row",
+			spec: `
+null_values: ["\\N"]
+tables:
+  - name: circuits
+    file: circuits.csv
+    key: circuitId
+    types: {circuitId: int}
+    rename: {name: circuitName}
+  - name: races
+    file: races.csv
+    types: {raceId: int, year: int, circuitId: int}
+    lookups:
+      - {field: circuitId, table: circuits, as: circuit}
+    drop: [circuitId]
+output: {table: races, file: out.json, key: "%raceId%"}
+`,
+			files: map[string]string{"circuits.csv": circuits, "races.csv": races},
+			want: `[
+				{"raceId":10,"year":2020,"name":"British GP","circuit":{"circuitId":1,"circuitName":"Silverstone","country":"UK"}},
+				{"raceId":11,"year":2020,"name":"Italian GP","circuit":{"circuitId":2,"circuitName":"Monza","country":"Italy"}},
+				{"raceId":12,"year":2021,"name":"Mystery GP","circuit":null},
+				{"raceId":13,"year":2021,"name":"TBC GP","circuit":null}
+			]`,
+		},
+		{
+			name: "lookup one column",
+			spec: `
+tables:
+  - name: circuits
+    file: circuits.csv
+    key: circuitId
+  - name: races
+    file: races.csv
+    lookups:
+      - {field: circuitId, table: circuits, as: country, select: country}
+    drop: [circuitId, year, name]
+output: {table: races, file: out.json, key: "%raceId%"}
+`,
+			files: map[string]string{"circuits.csv": circuits, "races.csv": races},
+			want:  `[{"raceId":"10","country":"UK"},{"raceId":"11","country":"Italy"},{"raceId":"12","country":null},{"raceId":"13","country":null}]`,
+		},
+		{
+			name: "lookup missing key as zero row",
+			spec: `
+null_values: ["\\N"]
+tables:
+  - name: circuits
+    file: circuits.csv
+    key: circuitId
+    types: {circuitId: int}
+    rename: {name: circuitName}
+  - name: races
+    file: races.csv
+    types: {raceId: int, circuitId: int}
+    lookups:
+      - {field: circuitId, table: circuits, as: circuit, zero_if_missing: true}
+      - {field: circuitId, table: circuits, as: country, select: country, zero_if_missing: true}
+    drop: [circuitId, year, name]
+output: {table: races, file: out.json, key: "%raceId%"}
+`,
+			files: map[string]string{"circuits.csv": circuits, "races.csv": races},
+			want: `[
+				{"raceId":10,"circuit":{"circuitId":1,"circuitName":"Silverstone","country":"UK"},"country":"UK"},
+				{"raceId":11,"circuit":{"circuitId":2,"circuitName":"Monza","country":"Italy"},"country":"Italy"},
+				{"raceId":12,"circuit":{"circuitId":0,"circuitName":"","country":""},"country":""},
+				{"raceId":13,"circuit":{"circuitId":0,"circuitName":"","country":""},"country":""}
+			]`,
+		},
+		{
+			name: "nest ordered",
+			spec: `
+null_values: ["\\N"]
+tables:
+  - name: results
+    file: results.csv
+    types: {raceId: int, position: int, lap: int}
+    drop: [raceId, resultId, lap]
+  - name: races
+    file: races.csv
+    key: raceId
+    types: {raceId: int}
+    embeds:
+      - {table: results, on: raceId, as: results, order_by: position}
+    drop: [year, circuitId]
+output: {table: races, file: out.json, key: "race::%raceId%"}
+`,
+			files: map[string]string{"results.csv": results, "races.csv": races},
+			want: `[
+				{"raceId":10,"name":"British GP","results":[{"driver":"HAM","position":1},{"driver":"VER","position":2}]},
+				{"raceId":11,"name":"Italian GP","results":[{"driver":"GAS","position":1},{"driver":"LEC","position":3},{"driver":"SAI","position":10}]},
+				{"raceId":12,"name":"Mystery GP","results":[]},
+				{"raceId":13,"name":"TBC GP","results":[]}
+			]`,
+		},
+		{
+			name: "nest in file order, null if empty",
+			spec: `
+tables:
+  - name: results
+    file: results.csv
+    drop: [raceId, resultId, lap, position]
+  - name: races
+    file: races.csv
+    key: raceId
+    embeds:
+      - {table: results, on: raceId, as: drivers, null_if_empty: true}
+    drop: [year, circuitId, name]
+output: {table: races, file: out.json, key: "%raceId%"}
+`,
+			files: map[string]string{"results.csv": results, "races.csv": races},
+			want: `[
+				{"raceId":"10","drivers":[{"driver":"HAM"},{"driver":"VER"}]},
+				{"raceId":"11","drivers":[{"driver":"GAS"},{"driver":"SAI"},{"driver":"LEC"}]},
+				{"raceId":"12","drivers":null},
+				{"raceId":"13","drivers":null}
+			]`,
+		},
+		{
+			name: "nest grouped",
+			spec: `
+tables:
+  - name: laps
+    file: laps.csv
+    types: {raceId: int, lap: int, time: float}
+    drop: [raceId, lap]
+  - name: races
+    file: races.csv
+    key: raceId
+    types: {raceId: int}
+    embeds:
+      - {table: laps, on: raceId, as: laps, group_by: lap, order_by: time, null_if_empty: true}
+    drop: [year, circuitId, name]
+output: {table: races, file: out.json, key: "%raceId%"}
+`,
+			files: map[string]string{"laps.csv": laps, "races.csv": races},
+			want: `[
+				{"raceId":10,"laps":[
+					[{"driver":"HAM","time":91.5},{"driver":"VER","time":92.0}],
+					[{"driver":"HAM","time":91.2}],
+					[{"driver":"HAM","time":90.1}]
+				]},
+				{"raceId":11,"laps":[[{"driver":"GAS","time":85.0}]]},
+				{"raceId":12,"laps":null},
+				{"raceId":13,"laps":null}
+			]`,
+		},
+		{
+			name: "lookup of embedded table",
+			spec: `
+null_values: ["\\N"]
+tables:
+  - name: circuits
+    file: circuits.csv
+    key: circuitId
+    types: {circuitId: int}
+  - name: results
+    file: results.csv
+    types: {raceId: int, position: int}
+    drop: [raceId, resultId, lap]
+  - name: races
+    file: races.csv
+    key: raceId
+    types: {raceId: int, circuitId: int}
+    lookups:
+      - {field: circuitId, table: circuits, as: circuit, select: name}
+    embeds:
+      - {table: results, on: raceId, as: winner, order_by: position}
+    drop: [year, circuitId]
+output: {table: races, file: out.json, key: "%raceId%"}
+`,
+			files: map[string]string{"circuits.csv": circuits, "results.csv": results, "races.csv": races},
+			want: `[
+				{"raceId":10,"name":"British GP","circuit":"Silverstone","winner":[{"driver":"HAM","position":1},{"driver":"VER","position":2}]},
+				{"raceId":11,"name":"Italian GP","circuit":"Monza","winner":[{"driver":"GAS","position":1},{"driver":"LEC","position":3},{"driver":"SAI","position":10}]},
+				{"raceId":12,"name":"Mystery GP","circuit":null,"winner":[]},
+				{"raceId":13,"name":"TBC GP","circuit":null,"winner":[]}
+			]`,
+		},
+		{
+			name: "duplicate key",
+			spec: `
+tables:
+  - name: races
+    file: races.csv
+output: {table: races, file: out.json, key: "%year%"}
+`,
+			files:   map[string]string{"races.csv": races},
+			wantErr: "duplicate output key",
+		},
+		{
+			name: "bad value",
+			spec: `
+tables:
+  - name: races
+    file: races.csv
+    types: {circuitId: int}
+output: {table: races, file: out.json, key: "%raceId%"}
+`,
+			files:   map[string]string{"races.csv": races},
+			wantErr: `line 5: field "circuitId"`,
+		},
+		{
+			name: "cycle",
+			spec: `
+tables:
+  - name: circuits
+    file: circuits.csv
+    key: circuitId
+    embeds:
+      - {table: races, on: circuitId, as: races}
+  - name: races
+    file: races.csv
+    lookups:
+      - {field: circuitId, table: circuits, as: circuit}
+output: {table: races, file: out.json, key: "%raceId%"}
+`,
+			files:   map[string]string{"circuits.csv": circuits, "races.csv": races},
+			wantErr: "cycle",
+		},
+		{
+			name: "unknown table",
+			spec: `
+tables:
+  - name: races
+    file: races.csv
+    lookups:
+      - {field: circuitId, table: circuit, as: circuit}
+output: {table: races, file: out.json, key: "%raceId%"}
+`,
+			files:   map[string]string{"races.csv": races},
+			wantErr: `lookup of unknown table "circuit"`,
+		},
+		{
+			name: "bad default",
+			spec: `
+tables:
+  - name: races
+    file: races.csv
+    types:
+      year: {type: int, default: soon}
+output: {table: races, file: out.json, key: "%raceId%"}
+`,
+			files:   map[string]string{"races.csv": races},
+			wantErr: "invalid default",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runSpec(t, tt.spec, tt.files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want any
+			if err = json.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatalf("bad test output: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				gotJSON, _ := json.Marshal(got)
+				t.Errorf("got %s\nwant %s", gotJSON, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package transform denormalises a set of related CSV files into JSON documents, as described by a YAML spec, so that
+// new datasets can be prepared without writing a program for each one.
+package transform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.uber.org/multierr"
+	"gopkg.in/yaml.v3"
+)
+
+// Spec describes how to build the output documents. Every table is read from a CSV file; the output table's rows become
+// the documents, with other tables' rows pulled into them by lookups and embeds.
+type Spec struct {
+	// NullValues are the raw values that mean a field has no value, such as "\N" in MySQL exports. They only apply to
+	// columns with a (non-string) type, as do empty fields, which are always null; string columns are left as they are.
+	NullValues []string `yaml:"null_values"`
+	Tables     []Table  `yaml:"tables"`
+	Output     Output   `yaml:"output"`
+
+	// dir is what relative file paths are taken relative to.
+	dir string
+}
+
+// Output describes the file the documents are written to.
+type Output struct {
+	Table string `yaml:"table"`
+	// File is written as a JSON array of documents.
+	File string `yaml:"file"`
+	// Key is the template for each document's key, in the same form as a dataset source's key (e.g. "%raceId%"). The
+	// documents are sorted by it, and it must be unique.
+	Key string `yaml:"key"`
+}
+
+type Table struct {
+	Name string `yaml:"name"`
+	File string `yaml:"file"`
+	// Key is the column that identifies each row, for other tables to look up or embed it.
+	Key     string              `yaml:"key"`
+	Types   map[string]Coercion `yaml:"types"`
+	Lookups []Lookup            `yaml:"lookups"`
+	Embeds  []Embed             `yaml:"embeds"`
+	// Rename and Drop are applied when the table's rows are output, whether as documents or inside other tables' rows.
+	// Everything else refers to the columns by their original names.
+	Rename map[string]string `yaml:"rename"`
+	Drop   []string          `yaml:"drop"`
+}
+
+// Lookup replaces a foreign key with the row it refers to (a many-to-one join).
+type Lookup struct {
+	// Field is the column holding the other table's key.
+	Field string `yaml:"field"`
+	Table string `yaml:"table"`
+	// As is the field to put the row in.
+	As string `yaml:"as"`
+	// Select takes just one column of the row rather than the whole thing.
+	Select string `yaml:"select"`
+	// ZeroIfMissing outputs a row with each of the table's columns set to its type's zero value (or just the selected
+	// column's zero value), rather than null, when the key is null or has no match. That's what a Go struct looked up in
+	// a map gives, as in the scripts this replaces.
+	ZeroIfMissing bool `yaml:"zero_if_missing"`
+}
+
+// Embed nests all the rows of another table that refer to this one into an array (a one-to-many join).
+type Embed struct {
+	Table string `yaml:"table"`
+	// On is the column in the other table holding this table's key.
+	On string `yaml:"on"`
+	As string `yaml:"as"`
+	// GroupBy splits the rows into an array of arrays, one per value of the column, in ascending order.
+	GroupBy string `yaml:"group_by"`
+	// OrderBy sorts the rows (within each group) by the column. Otherwise, they stay in file order.
+	OrderBy string `yaml:"order_by"`
+	// NullIfEmpty outputs null rather than an empty array when there are no rows.
+	NullIfEmpty bool `yaml:"null_if_empty"`
+}
+
+type FieldType string
+
+const (
+	TypeString FieldType = "string"
+	TypeInt    FieldType = "int"
+	TypeFloat  FieldType = "float"
+	TypeBool   FieldType = "bool"
+)
+
+// Coercion converts a column from a string. It can be written as just the type, or as an object with a default to use
+// instead of null.
+type Coercion struct {
+	Type    FieldType `yaml:"type"`
+	Default *string   `yaml:"default"`
+
+	defaultValue any
+}
+
+func (c *Coercion) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*c = Coercion{Type: FieldType(value.Value)}
+		return nil
+	}
+	type plain Coercion
+	return value.Decode((*plain)(c))
+}
+
+// zero returns the type's zero value.
+func (c Coercion) zero() any {
+	switch c.Type {
+	case TypeInt:
+		return int64(0)
+	case TypeFloat:
+		return 0.0
+	case TypeBool:
+		return false
+	default:
+		return ""
+	}
+}
+
+func (c Coercion) apply(raw string) (any, error) {
+	switch c.Type {
+	case TypeString, "":
+		return raw, nil
+	case TypeInt:
+		return strconv.ParseInt(raw, 10, 64)
+	case TypeFloat:
+		return strconv.ParseFloat(raw, 64)
+	case TypeBool:
+		return strconv.ParseBool(raw)
+	default:
+		return nil, fmt.Errorf("unknown type %q", c.Type)
+	}
+}
+
+// LoadSpec reads and validates a spec. Relative paths in it are taken relative to the spec file.
+func LoadSpec(path string) (*Spec, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open %q: %w", path, err)
+	}
+	defer fd.Close()
+	dec := yaml.NewDecoder(fd)
+	dec.KnownFields(true)
+	var spec Spec
+	if err = dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("decode %q: %w", path, err)
+	}
+	spec.dir = filepath.Dir(path)
+	if err = spec.validate(); err != nil {
+		return nil, fmt.Errorf("validate %q: %w", path, err)
+	}
+	return &spec, nil
+}
+
+func (s *Spec) path(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(s.dir, file)
+}
+
+func (s *Spec) table(name string) (*Table, bool) {
+	for i := range s.Tables {
+		if s.Tables[i].Name == name {
+			return &s.Tables[i], true
+		}
+	}
+	return nil, false
+}
+
+func (s *Spec) validate() error {
+	var errs error
+	seen := make(map[string]bool)
+	for i := range s.Tables {
+		t := &s.Tables[i]
+		if t.Name == "" {
+			multierr.AppendInto(&errs, fmt.Errorf("table %d has no name", i))
+			continue
+		}
+		if seen[t.Name] {
+			multierr.AppendInto(&errs, fmt.Errorf("duplicate table %q", t.Name))
+		}
+		seen[t.Name] = true
+		if t.File == "" {
+			multierr.AppendInto(&errs, fmt.Errorf("table %q has no file", t.Name))
+		}
+		for field, c := range t.Types {
+			switch c.Type {
+			case "", TypeString, TypeInt, TypeFloat, TypeBool:
+			default:
+				multierr.AppendInto(&errs, fmt.Errorf("table %q: field %q: unknown type %q", t.Name, field, c.Type))
+				continue
+			}
+			if c.Default != nil {
+				val, err := c.apply(*c.Default)
+				if err != nil {
+					multierr.AppendInto(&errs, fmt.Errorf("table %q: field %q: invalid default: %w", t.Name, field, err))
+				}
+				c.defaultValue = val
+				t.Types[field] = c
+			}
+		}
+	}
+	for _, t := range s.Tables {
+		for _, l := range t.Lookups {
+			ref, ok := s.table(l.Table)
+			switch {
+			case l.Field == "" || l.As == "":
+				multierr.AppendInto(&errs, fmt.Errorf("table %q: lookups need a field and an as", t.Name))
+			case !ok:
+				multierr.AppendInto(&errs, fmt.Errorf("table %q: lookup of unknown table %q", t.Name, l.Table))
+			case ref.Key == "":
+				multierr.AppendInto(&errs, fmt.Errorf("table %q: can't look up table %q as it has no key", t.Name, l.Table))
+			}
+		}
+		for _, e := range t.Embeds {
+			_, ok := s.table(e.Table)
+			switch {
+			case e.On == "" || e.As == "":
+				multierr.AppendInto(&errs, fmt.Errorf("table %q: embeds need an on and an as", t.Name))
+			case !ok:
+				multierr.AppendInto(&errs, fmt.Errorf("table %q: embed of unknown table %q", t.Name, e.Table))
+			case t.Key == "":
+				multierr.AppendInto(&errs, fmt.Errorf("table %q: can't embed %q as it has no key", t.Name, e.Table))
+			}
+		}
+	}
+	if _, ok := s.table(s.Output.Table); !ok {
+		multierr.AppendInto(&errs, fmt.Errorf("unknown output table %q", s.Output.Table))
+	}
+	if s.Output.File == "" {
+		multierr.AppendInto(&errs, fmt.Errorf("no output file"))
+	}
+	if s.Output.Key == "" {
+		multierr.AppendInto(&errs, fmt.Errorf("no output key"))
+	}
+	if errs != nil {
+		return errs
+	}
+	if _, err := s.order(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// order returns the tables in the order they need to be built, so that every table comes after the ones it looks up or
+// embeds. It fails if they depend on each other in a cycle.
+func (s *Spec) order() ([]*Table, error) {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var result []*Table
+	var visit func(t *Table, path []string) error
+	visit = func(t *Table, path []string) error {
+		switch state[t.Name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("tables depend on each other in a cycle: %v", append(path, t.Name))
+		}
+		state[t.Name] = visiting
+		deps := make([]string, 0, len(t.Lookups)+len(t.Embeds))
+		for _, l := range t.Lookups {
+			deps = append(deps, l.Table)
+		}
+		for _, e := range t.Embeds {
+			deps = append(deps, e.Table)
+		}
+		for _, dep := range deps {
+			depTable, _ := s.table(dep)
+			if err := visit(depTable, append(path, t.Name)); err != nil {
+				return err
+			}
+		}
+		state[t.Name] = done
+		result = append(result, t)
+		return nil
+	}
+	for i := range s.Tables {
+		if err := visit(&s.Tables[i], nil); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
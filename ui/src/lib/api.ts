@@ -1,3 +1,5 @@
+import { QueryFailure } from "./types";
+
 const apiPrefix = import.meta.env.VITE_PUBLIC_API_PREFIX ?? "/api";
 
 export class APIError extends Error {
@@ -92,3 +94,10 @@ export function formatError(e: unknown): string {
     return String(e);
   }
 }
+
+export function formatQueryFailure(f: QueryFailure): string {
+  if (f.line && f.column) {
+    return `${f.message} (line ${f.line}, column ${f.column})`;
+  }
+  return f.message;
+}
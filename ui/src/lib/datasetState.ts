@@ -19,14 +19,24 @@ export interface Query {
   hints: string[] | null;
   numHints: number;
   complete: boolean;
+  closed: boolean;
+  availableFrom?: string;
+  availableUntil?: string;
+}
+
+interface DatasetsResponse {
+  datasets: Dataset[];
+  nextRelease: string | null;
 }
 
 export const useDatasets = defineStore("datasets", {
-  state: () => ({datasets: null as Dataset[] | null, error: null as string | null}),
+  state: () => ({datasets: null as Dataset[] | null, nextRelease: null as string | null, error: null as string | null}),
   actions: {
     async refresh() {
       try {
-        this.datasets = await doAPIRequest("GET", "/datasets", 200) as Dataset[]
+        const res = await doAPIRequest<DatasetsResponse>("GET", "/datasets", 200);
+        this.datasets = res.datasets;
+        this.nextRelease = res.nextRelease;
       } catch (e) {
         this.error = formatError(e);
       }
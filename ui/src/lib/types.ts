@@ -7,3 +7,20 @@ export interface Team {
 
 export type Scoreboard = Record<string, number>;
 export type CompletedChallenges = Record<string, Record<string, Record<string, boolean>>>;
+
+// QueryFailure is why a query failed, as described by the query service.
+export interface QueryFailure {
+    code?: number;
+    message: string;
+    line?: number;
+    column?: number;
+}
+
+// QueryResult is the response to running a query. If it was truncated, rows only has as many as the server would
+// send. An error part way through the query is in error, after any rows that came before it.
+export interface QueryResult {
+    rows: unknown[];
+    truncated: boolean;
+    metrics?: Record<string, unknown>;
+    error?: QueryFailure;
+}